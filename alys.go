@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RBLR results can be loaded straight from the Alys database as well as from its JSON
+// export. The database also tells us the date of the ride so the operator needn't type
+// it in. Entrant columns carry a Rider or Pillion prefix on the RBLR_Person fields.
+
+// alysDateColumns may hold the date of the ride in the Alys config table
+var alysDateColumns = []string{"eventdate", "ridedate", "startdate", "rallystart", "starttime"}
+
+// parse_alys reads an uploaded Alys database
+func parse_alys(data []byte) (ds RBLR_Dataset, eventdate string, err error) {
+
+	terr := with_temp_db(data, func(path string) {
+		ds, eventdate, err = read_alys_file(path)
+	})
+	if terr != nil {
+		err = terr
+	}
+	return
+}
+
+// read_alys_file reads the entrants, and the date of the ride, from an Alys database
+func read_alys_file(path string) (RBLR_Dataset, string, error) {
+
+	ds := RBLR_Dataset{Database: true} // Not an export so there's no Filetype or Asat
+	db, err := open_source_db(path)
+	if err != nil {
+		return ds, "", err
+	}
+	defer db.Close()
+
+	ok, err := sqlite_has_table(db, "entrants")
+	if err != nil {
+		return ds, "", err
+	}
+	if !ok {
+		return ds, "", errors.New("This isn't an Alys database, it has no entrants table")
+	}
+	rows, err := sqlite_rows(db, "SELECT * FROM entrants ORDER BY EntrantID")
+	if err != nil {
+		return ds, "", err
+	}
+	if len(rows) > 0 {
+		if _, ok := rows[0]["route"]; !ok {
+			return ds, "", errors.New("This isn't an Alys database, its entrants have no routes")
+		}
+	}
+	for _, e := range rows {
+		var re RBLR_Entrant
+		re.EntrantID = sqlite_int(e["entrantid"])
+		re.EntrantStatus = RBLR_Status(sqlite_int(e["entrantstatus"]))
+		re.Rider = alys_person(e, "rider")
+		re.Pillion = alys_person(e, "pillion")
+		re.NokName = e["nokname"]
+		re.NokRelation = e["nokrelation"]
+		re.NokPhone = e["nokphone"]
+		re.Bike = e["bike"]
+		re.BikeReg = e["bikereg"]
+		re.Route = e["route"]
+		re.OdoStart = e["odostart"]
+		re.OdoFinish = e["odofinish"]
+		re.OdoCounts = e["odocounts"]
+		re.StartTime = e["starttime"]
+		re.FinishTime = e["finishtime"]
+		re.Notes = e["notes"]
+		ds.Entrants = append(ds.Entrants, re)
+	}
+
+	eventdate, err := alys_event_date(db, rows)
+	return ds, eventdate, err
+}
+
+// alys_person picks out the rider or pillion columns of an entrants row
+func alys_person(e map[string]string, prefix string) RBLR_Person {
+
+	p := RBLR_Person{
+		First:    e[prefix+"first"],
+		Last:     e[prefix+"last"],
+		IBA:      e[prefix+"iba"],
+		RBL:      e[prefix+"rbl"],
+		Email:    e[prefix+"email"],
+		Phone:    e[prefix+"phone"],
+		Address1: e[prefix+"address1"],
+		Address2: e[prefix+"address2"],
+		Town:     e[prefix+"town"],
+		County:   e[prefix+"county"],
+		Postcode: e[prefix+"postcode"],
+		Country:  e[prefix+"country"],
+	}
+	if p.IBA == "" {
+		p.IBA = e[prefix+"ibanumber"]
+	}
+	p.HasIBANumber = p.IBA != "" || sqlite_int(e[prefix+"hasibanumber"]) != 0
+	return p
+}
+
+// alys_event_date returns the date of the ride from the config table or, failing that,
+// the earliest start time recorded.
+func alys_event_date(db *sql.DB, entrants []map[string]string) (string, error) {
+
+	ok, err := sqlite_has_table(db, "config")
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		cfg, err := sqlite_rows(db, "SELECT * FROM config")
+		if err != nil {
+			return "", err
+		}
+		for _, c := range alysDateColumns {
+			if len(cfg) > 0 && alys_date(cfg[0][c]) != "" {
+				return alys_date(cfg[0][c]), nil
+			}
+		}
+	}
+	res := ""
+	for _, e := range entrants {
+		if d := alys_date(e["starttime"]); d != "" && (res == "" || d < res) {
+			res = d
+		}
+	}
+	return res, nil
+}
+
+// alys_ride_date checks the Saturday typed by the operator against the Alys database
+func alys_ride_date(saturday string, eventdate string) (string, error) {
+
+	switch {
+	case eventdate == "":
+		return saturday, nil
+	case saturday == "":
+		return eventdate, nil
+	case saturday != eventdate:
+		return "", fmt.Errorf("The Alys database is for the ride on %v, not %v", eventdate, saturday)
+	}
+	return saturday, nil
+}
+
+// alys_date extracts a valid date from the start of an Alys timestamp
+func alys_date(x string) string {
+
+	x = strings.TrimSpace(x)
+	if len(x) < 10 {
+		return ""
+	}
+	if _, err := time.Parse("2006-01-02", x[:10]); err != nil {
+		return ""
+	}
+	return x[:10]
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rupert updates the Rides database so all but the help pages require a login.
+// Users are held in rupert_users with salted PBKDF2 password hashes and logins
+// are tracked by a random token in a cookie, only the hash of which is stored.
+
+// SecureCookie forces the Secure attribute on the login cookie even when Rupert
+// itself isn't serving HTTPS, as when behind a proxy which doesn't say so.
+var SecureCookie *bool = flag.Bool("securecookie", false, "always mark the login cookie as Secure")
+
+const (
+	loginCookie     = "rupert_login"
+	loginLifetime   = 12 * time.Hour
+	pbkdf2Iters     = 200000
+	pbkdf2KeyLength = 32
+)
+
+type contextKey string
+
+const userKey contextKey = "user"
+
+// pbkdf2_sha256 derives a key from a password as described in RFC 8018
+func pbkdf2_sha256(password []byte, salt []byte, iters int, keylen int) []byte {
+
+	prf := hmac.New(sha256.New, password)
+	res := make([]byte, 0, keylen)
+	buf := make([]byte, 4)
+	for block := uint32(1); len(res) < keylen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, block)
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iters; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		res = append(res, t...)
+	}
+	return res[:keylen]
+}
+
+// hash_password returns a string holding the algorithm, iterations, salt and hash
+func hash_password(password string) (string, error) {
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2_sha256([]byte(password), salt, pbkdf2Iters, pbkdf2KeyLength)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%v$%v$%v", pbkdf2Iters, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func check_password(password string, stored string) bool {
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iters, err := strconv.Atoi(parts[1])
+	if err != nil || iters < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(pbkdf2_sha256([]byte(password), salt, iters, len(want)), want)
+}
+
+// add_user creates a user or, if they already exist, changes their password
+func add_user(db dbrunner, username string, password string) error {
+
+	if username == "" || password == "" {
+		return errors.New("a user needs both a name and a password")
+	}
+	hash, err := hash_password(password)
+	if err != nil {
+		return err
+	}
+	sqlx := `INSERT INTO rupert_users (Username,PasswordHash,CreatedAt) VALUES(?,?,?)
+		ON CONFLICT(Username) DO UPDATE SET PasswordHash=excluded.PasswordHash`
+	_, err = db.Exec(sqlx, username, hash, time.Now().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+// add_user_from_console sets up a user from the command line, reading their password
+// from standard input so that it doesn't appear in the process list or shell history.
+// An empty role leaves an existing user's permissions as they are, only a new user
+// must be given one.
+func add_user_from_console(username string, role string, rallies []string) error {
+
+	if role != "" && !slices.Contains(validRoles, role) {
+		return fmt.Errorf("role must be one of %v", strings.Join(validRoles, ", "))
+	}
+	if role == "" && len(rallies) > 0 {
+		return errors.New("-rallies needs a -role")
+	}
+	existing, err := getStringFromDB(DBH, "SELECT Role FROM rupert_users WHERE Username=?", "", username)
+	if err != nil {
+		return err
+	}
+	n, err := getIntegerFromDB(DBH, "SELECT count(*) FROM rupert_users WHERE Username=?", 0, username)
+	if err != nil {
+		return err
+	}
+	if n == 0 && role == "" {
+		return fmt.Errorf("%v is a new user and needs a -role", username)
+	}
+	fmt.Fprintf(os.Stderr, "Password for %v: ", username)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	tx, err := DBH.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = add_user(tx, username, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		err = set_user_role(tx, username, role, rallies)
+		if err != nil {
+			return err
+		}
+		existing = role
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %v saved as %v\n", username, existing)
+	return nil
+}
+
+func login_token_hash(token string) string {
+
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// start_login records a new login for username and returns its token
+func start_login(username string) (string, time.Time, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(loginLifetime)
+	_, err := DBH.Exec("DELETE FROM rupert_logins WHERE Expires<?", time.Now().Unix())
+	if err != nil {
+		return "", expires, err
+	}
+	_, err = DBH.Exec("INSERT INTO rupert_logins (TokenHash,Username,Expires) VALUES(?,?,?)", login_token_hash(token), username, expires.Unix())
+	return token, expires, err
+}
+
+// logged_in_user returns the user identified by the request's login cookie, if any
+func logged_in_user(r *http.Request) string {
+
+	c, err := r.Cookie(loginCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	sqlx := "SELECT Username FROM rupert_logins WHERE TokenHash=? AND Expires>=?"
+	user, err := getStringFromDB(DBH, sqlx, "", login_token_hash(c.Value), time.Now().Unix())
+	if err != nil {
+		return ""
+	}
+	return user
+}
+
+// current_user is the user running this request, as established by require_login
+func current_user(r *http.Request) rupert_User {
+
+	user, _ := r.Context().Value(userKey).(rupert_User)
+	return user
+}
+
+func set_login_cookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   *SecureCookie || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// require_login wraps handlers which need a logged in user
+func require_login(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := logged_in_user(r)
+		if username == "" {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		user, err := load_user(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPost && !parse_post(w, r) {
+			return
+		}
+		if r.Method == http.MethodPost && !check_csrf(r) {
+			show_forbidden(w, "This form has expired or didn't come from Rupert, please reload the page and try again.")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	}
+}
+
+// safe_next only allows redirection within Rupert after logging in
+func safe_next(next string) string {
+
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func show_login(w http.ResponseWriter, r *http.Request) {
+
+	next := safe_next(r.FormValue("next"))
+	msg := ""
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.FormValue("username"))
+		hash, err := getStringFromDB(DBH, "SELECT PasswordHash FROM rupert_users WHERE Username=?", "", username)
+		if err == nil && check_password(r.FormValue("password"), hash) {
+			token, expires, err := start_login(username)
+			if err == nil {
+				set_login_cookie(w, r, token, expires)
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+			msg = err.Error()
+		} else {
+			msg = "Unknown user or wrong password"
+		}
+	}
+
+	render(w, "login", struct{ Next, Error string }{next, msg})
+}
+
+func show_logout(w http.ResponseWriter, r *http.Request) {
+
+	if c, err := r.Cookie(loginCookie); err == nil {
+		DBH.Exec("DELETE FROM rupert_logins WHERE TokenHash=?", login_token_hash(c.Value))
+	}
+	set_login_cookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
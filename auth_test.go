@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+
+	tests := []struct {
+		password string
+		salt     string
+		iters    int
+		want     string
+	}{
+		// RFC 7914 section 11
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		// The RFC 6070 inputs, with SHA-256
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	}
+	for _, tc := range tests {
+		want, _ := hex.DecodeString(tc.want)
+		got := pbkdf2_sha256([]byte(tc.password), []byte(tc.salt), tc.iters, len(want))
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("pbkdf2_sha256(%q, %q, %v) = %x, want %v", tc.password, tc.salt, tc.iters, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+
+	stored, err := hash_password("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check_password("correct horse", stored) {
+		t.Error("the right password was refused")
+	}
+	for _, bad := range []string{"Correct horse", "", "correct horse "} {
+		if check_password(bad, stored) {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+	for _, bad := range []string{"", "bcrypt$1$a$b", "pbkdf2-sha256$0$c2FsdA$AAAA", "pbkdf2-sha256$x$c2FsdA$AAAA"} {
+		if check_password("", bad) {
+			t.Errorf("stored hash %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Results can also be loaded from a script on the server itself, for example
+//
+//	rupert import-rally -code XYZ -year 2025 results.csv
+//	rupert import-rally -code XYZ ScoreMaster.db
+//	rupert import-rally -code XYZ -year 2025 -sheet Finishers results.xlsx
+//	rupert import-rblr -saturday 2025-06-14 alys.json
+//	rupert import-rblr alys.db
+//
+// using the same parsing and posting as the web pages. The exit code is non-zero if
+// the file couldn't be loaded; a file with no entrants to load still succeeds.
+
+// run_subcommand carries out a command line request and returns the exit code
+func run_subcommand(args []string) int {
+
+	var err error
+	switch args[0] {
+	case "import-rally":
+		err = cli_import_rally(args[1:])
+	case "import-rblr":
+		err = cli_import_rblr(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %v, expecting import-rally or import-rblr", args[0])
+	}
+	if err == nil {
+		return 0
+	}
+	if !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", args[0], err)
+	}
+	return 1
+}
+
+// cli_import_flags adds the flags shared by all the import commands
+func cli_import_flags(fs *flag.FlagSet) (preview *bool, accept *bool, by *string) {
+
+	preview = fs.Bool("preview", false, "show what would be loaded without changing the database")
+	accept = fs.Bool("accept", false, "use the best match for riders who might or might not be on file")
+	by = fs.String("by", os.Getenv("USER"), "name recorded against the import")
+	return
+}
+
+// cli_read_file parses the flags and reads the single file named after them
+func cli_read_file(fs *flag.FlagSet, args []string) ([]byte, error) {
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, errors.New("exactly one results file is needed")
+	}
+	return os.ReadFile(fs.Arg(0))
+}
+
+// cli_loaded_by is recorded as the LoadedBy of a command line import
+func cli_loaded_by(by string) string {
+
+	if by == "" {
+		by = "unknown"
+	}
+	return "console:" + by
+}
+
+func cli_import_rally(args []string) error {
+
+	fs := flag.NewFlagSet("import-rally", flag.ContinueOnError)
+	code := fs.String("code", "", "short code of the rally")
+	desc := fs.String("desc", "", "full title, if the rally is new")
+	year := fs.String("year", "", "year of the results, optional for a ScoreMaster database")
+	sheet := fs.String("sheet", "", "sheet holding the results in an Excel workbook, the first if not given")
+	preview, accept, by := cli_import_flags(fs)
+	data, err := cli_read_file(fs, args)
+	if err != nil {
+		return err
+	}
+	rp := new_rally_params(*code, *year, *desc)
+	if rp.Code == "" {
+		return errors.New("no rallycode supplied")
+	}
+
+	// A ScoreMaster database can be read where it is, CSV files are parsed from memory
+	var entrants []rally_Entrant
+	var problems []string
+	var warning string
+	switch {
+	case is_sqlite(data):
+		var sr scoremaster_Rally
+		sr, entrants, problems = read_scoremaster_file(fs.Arg(0))
+		warning = use_scoremaster_rally(&rp, sr)
+	case is_xlsx(data):
+		wb, err := open_xlsx(data)
+		if err != nil {
+			return err
+		}
+		entrants, problems = parse_rally_xlsx(wb, *sheet)
+	default:
+		entrants, problems = parse_rally(decode_text(data))
+	}
+	if len(problems) > 0 {
+		return errors.New("the file cannot be imported\n" + strings.Join(problems, "\n"))
+	}
+	if rp.Year == "" {
+		return errors.New("no year supplied")
+	}
+	sess, err := new_import_session(*preview, make(map[string]int64))
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		sess.Warnings = append(sess.Warnings, warning)
+	}
+	if !*preview && !*accept {
+		err = cli_check_ambiguities(sess, rally_match_people(entrants))
+		if err != nil {
+			return err
+		}
+	}
+	err = run_import(sess, func(sess *import_Session) error {
+		return post_rally_entrants(sess, entrants, rp, string(data), cli_loaded_by(*by))
+	})
+	if err != nil {
+		return cli_import_failure(err)
+	}
+	cli_show_summary(sess)
+	return nil
+}
+
+func cli_import_rblr(args []string) error {
+
+	fs := flag.NewFlagSet("import-rblr", flag.ContinueOnError)
+	saturday := fs.String("saturday", "", "date of the ride, yyyy-mm-dd, optional for an Alys database")
+	allfinishers := fs.Bool("allfinishers", false, "also record late finishers and 500 mile routes")
+	participation := fs.Bool("participation", false, "record starters in the participation report")
+	preview, accept, by := cli_import_flags(fs)
+	data, err := cli_read_file(fs, args)
+	if err != nil {
+		return err
+	}
+	var ds RBLR_Dataset
+	ridedate := *saturday
+	if is_sqlite(data) {
+		var eventdate string
+		ds, eventdate, err = read_alys_file(fs.Arg(0))
+		if err == nil {
+			ridedate, err = alys_ride_date(ridedate, eventdate)
+		}
+	} else {
+		ds, err = parse_rblr(decode_text(data))
+	}
+	if err != nil {
+		return err
+	}
+	entrants := ds.Entrants
+	rp, err := new_rblr_params(ridedate, *allfinishers, *participation)
+	if err != nil {
+		return err
+	}
+	warnings, err := check_rblr_dataset(ds, rp.Ridedate)
+	if err != nil {
+		return err
+	}
+	sess, err := new_import_session(*preview, make(map[string]int64))
+	if err == nil {
+		sess.Routes, err = rblr_routes_on(DBH, rp.Ridedate)
+	}
+	if err != nil {
+		return err
+	}
+	sess.Warnings = append(sess.Warnings, warnings...)
+	if !*preview && !*accept {
+		err = cli_check_ambiguities(sess, rblr_match_people(sess, rp, entrants))
+		if err != nil {
+			return err
+		}
+	}
+	err = run_import(sess, func(sess *import_Session) error {
+		return post_rblr_entrants(sess, entrants, rp, string(data), cli_loaded_by(*by))
+	})
+	if err != nil {
+		return cli_import_failure(err)
+	}
+	cli_show_summary(sess)
+	for _, rt := range sess.Routes {
+		fmt.Printf("%v: %v  ", rt.Code, sess.Stats.Routes[rt.Code])
+	}
+	fmt.Println()
+	if rp.AllFinishers {
+		fmt.Printf("Not IBA qualified: late finishers %v, 500 mile routes %v\n", sess.Stats.LateRides, sess.Stats.ShortRides)
+	}
+	for _, sc := range rblr_status_counts(entrants) {
+		fmt.Printf("%v: %v\n", sc.Status, sc.Count)
+	}
+	if rp.Participation {
+		fmt.Printf("Starters added to the participation record: %v\n", sess.Stats.Participants)
+	}
+	return nil
+}
+
+// cli_check_ambiguities lists the people the web pages would ask about. There's nobody
+// to ask here so the import is refused unless -accept was given.
+func cli_check_ambiguities(sess *import_Session, people []match_Person) error {
+
+	amb := find_ambiguities(sess, people)
+	if len(amb) < 1 {
+		return nil
+	}
+	for _, a := range amb {
+		fmt.Printf("%v: %v\n", a.Person.Name, a.Reason)
+		for _, c := range a.Cands {
+			fmt.Printf("    rider %v: %v, %v%% on %v\n", c.Riderid, c.Name, c.Score, c.Evidence)
+		}
+	}
+	return fmt.Errorf("%v entrants might or might not be on file, use -accept to take the best matches or load the file through the web pages", len(amb))
+}
+
+// cli_import_failure explains an import which was rolled back
+func cli_import_failure(err error) error {
+
+	var ie import_Error
+	if errors.As(err, &ie) {
+		return fmt.Errorf("import rolled back while recording %v: %w", ie.Entrant, ie.Err)
+	}
+	return fmt.Errorf("import rolled back: %w", err)
+}
+
+// cli_show_summary prints the same figures as the web results page
+func cli_show_summary(sess *import_Session) {
+
+	for _, a := range sess.Actions {
+		fmt.Printf("%v: %v; %v; %v\n", a.Entrant, a.Rider, a.Bike, a.Ride)
+	}
+	for _, x := range sess.Warnings {
+		fmt.Printf("Warning: %v\n", x)
+	}
+	if sess.Preview {
+		fmt.Println("This is a preview only, nothing has been written to the database.")
+	}
+	fmt.Printf("New rides: %v\n", sess.Stats.NewRides)
+	fmt.Printf("New riders: %v, new pillions: %v\n", sess.Stats.NewRiders, sess.Stats.NewPillions)
+	fmt.Printf("New IBA members: %v\n", len(sess.NewIBAs))
+	for _, x := range sess.NewIBAs {
+		fmt.Printf("    %v\n", x)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Forms which change anything carry a token derived from the login cookie. A page
+// on another site can make the browser send the cookie but can't read it, so can't
+// supply the matching token.
+
+const csrfField = "csrf"
+
+// csrf_token is the token for the login making this request
+func csrf_token(r *http.Request) string {
+
+	c, err := r.Cookie(loginCookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(c.Value))
+	mac.Write([]byte(csrfField))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func check_csrf(r *http.Request) bool {
+
+	want := csrf_token(r)
+	return want != "" && hmac.Equal([]byte(r.FormValue(csrfField)), []byte(want))
+}
+
+// allow_methods rejects requests using any other method, returning false if it did.
+// HEAD is allowed wherever GET is, so a handler which changes anything must test for
+// POST, which alone is checked for CSRF, rather than for GET.
+func allow_methods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+
+	for _, m := range methods {
+		if r.Method == m || (r.Method == http.MethodHead && m == http.MethodGet) {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results of events other than rallies and the RBLR come as spreadsheets laid out however
+// the organiser likes. On /event the operator says which column holds each field of the
+// riders, bikes and rides records and may save that as a named template to use with the
+// next file. Templates map headings, normalized as for rally files, rather than column
+// positions so columns may move about between one year and the next.
+
+// event_Entrant is one line of an event results file
+type event_Entrant struct {
+	rally_Entrant        // Rider, pillion and bike, recorded as for a rally
+	RiderFirst    string // Used if there's no rider name column
+	RiderLast     string
+	RideDate      string // yyyy-mm-dd
+	FinishDate    string
+	RideName      string // IBA_Ride
+	StartPoint    string
+	FinishPoint   string
+	Via           string
+	StartOdo      string
+	FinishOdo     string
+	StartTime     string
+	FinishTime    string
+	Notes         string
+}
+
+// event_Params gives the event name and the ride details used where the file doesn't
+type event_Params struct {
+	EventName string
+	RideName  string
+	RideDate  string
+}
+
+type event_Field struct {
+	Field    string // Name of the event_Entrant field
+	Label    string
+	Headings []string // Taken as this field unless a template says otherwise, normalized
+}
+
+// event_Field_Group lists the fields held in one table of the Rides database
+type event_Field_Group struct {
+	Table  string
+	Fields []event_Field
+}
+
+var eventFields = []event_Field_Group{
+	{"Rider", []event_Field{
+		{"RiderName", "Rider name", []string{"ridername", "rider", "name", "fullname"}},
+		{"RiderFirst", "Rider first name", []string{"riderfirst", "firstname", "first", "forename"}},
+		{"RiderLast", "Rider last name", []string{"riderlast", "lastname", "last", "surname"}},
+		{"RiderIBA", "Rider IBA number", []string{"rideriba", "iba", "ibanumber", "ibano"}},
+		{"Email", "Email", []string{"email", "rideremail", "emailaddress"}},
+		{"Phone", "Phone", []string{"phone", "riderphone", "mobile", "telephone"}},
+		{"Postal_Address", "Postal address", []string{"postaladdress", "address"}},
+		{"Postcode", "Postcode", []string{"postcode", "zip", "zipcode"}},
+		{"Country", "Country", []string{"country"}},
+		{"PillionName", "Pillion name", []string{"pillionname", "pillion"}},
+		{"PillionIBA", "Pillion IBA number", []string{"pillioniba", "pillionibanumber"}},
+	}},
+	{"Bike", []event_Field{
+		{"Bike", "Bike", []string{"bike", "motorcycle", "makemodel"}},
+		{"BikeReg", "Registration", []string{"bikereg", "registration", "reg"}},
+		{"KmsOdo", "Odometer in kilometres", []string{"kmsodo", "odokms", "odounits"}},
+	}},
+	{"Ride", []event_Field{
+		{"RideDate", "Date ride started", []string{"ridedate", "date", "startdate", "datestarted"}},
+		{"FinishDate", "Date ride finished", []string{"finishdate", "datefinished"}},
+		{"RideName", "IBA ride name", []string{"ridename", "ibaride", "ride"}},
+		{"Miles", "Miles", []string{"miles", "totalmiles", "distance"}},
+		{"StartPoint", "Start point", []string{"startpoint", "start"}},
+		{"FinishPoint", "Finish point", []string{"finishpoint", "finish"}},
+		{"Via", "Via", []string{"via", "midpoints", "route"}},
+		{"StartOdo", "Start odometer", []string{"startodo", "odostart"}},
+		{"FinishOdo", "Finish odometer", []string{"finishodo", "odofinish"}},
+		{"StartTime", "Start time", []string{"starttime", "timestart"}},
+		{"FinishTime", "Finish time", []string{"finishtime", "timefinish"}},
+		{"Notes", "Notes", []string{"notes", "comments"}},
+	}},
+}
+
+// Form fields mapping columns are named for the column number
+const eventColumnPrefix = "col_"
+
+// event_Column is a column of the file being imported and the field it holds
+type event_Column struct {
+	Index   int
+	Heading string
+	Sample  string // The first value, to remind the operator what's there
+	Field   string // Blank if the column is ignored
+}
+
+func (c event_Column) Input() string {
+
+	return eventColumnPrefix + strconv.Itoa(c.Index)
+}
+
+// event_Mapping is shown on the import page for the operator to check or complete
+type event_Mapping struct {
+	Columns  []event_Column
+	Groups   []event_Field_Group
+	Template string // Suggested name for saving the mapping
+	Problems []string
+}
+
+// Dates in event files may well have been typed by hand
+var eventDateFormats = []string{"02/01/2006", "2/1/2006", "02/01/06", "2/1/06", "2 Jan 2006", "2 January 2006", "02-Jan-2006", "02-Jan-06", "2006/01/02"}
+
+// find_event_field looks up one of the eventFields
+func find_event_field(name string) (event_Field, bool) {
+
+	for _, g := range eventFields {
+		for _, f := range g.Fields {
+			if f.Field == name {
+				return f, true
+			}
+		}
+	}
+	return event_Field{}, false
+}
+
+// guess_event_field suggests the field held under a normalized heading
+func guess_event_field(heading string) string {
+
+	for _, g := range eventFields {
+		for _, f := range g.Fields {
+			for _, h := range f.Headings {
+				if h == heading {
+					return f.Field
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// read_event_file reads the lines of an uploaded CSV, headings first
+func read_event_file(data []byte) ([][]string, error) {
+
+	rdr := csv.NewReader(strings.NewReader(decode_text(data)))
+	rdr.FieldsPerRecord = -1
+	recs, err := rdr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) < 2 {
+		return nil, errors.New("The file has no results in it")
+	}
+	return recs, nil
+}
+
+// event_columns describes the columns of a file, mapped by a template or, if there
+// isn't one, by guesswork. Each field is taken from the first column offering it.
+func event_columns(recs [][]string, template map[string]string) []event_Column {
+
+	used := make(map[string]bool)
+	res := make([]event_Column, 0, len(recs[0]))
+	for ix, h := range recs[0] {
+		c := event_Column{Index: ix, Heading: strings.TrimSpace(h)}
+		for _, ln := range recs[1:] {
+			if ix < len(ln) && strings.TrimSpace(ln[ix]) != "" {
+				c.Sample = strings.TrimSpace(ln[ix])
+				break
+			}
+		}
+		if template != nil {
+			c.Field = template[normalize_heading(h)]
+		} else {
+			c.Field = guess_event_field(normalize_heading(h))
+		}
+		if _, ok := find_event_field(c.Field); !ok || used[c.Field] {
+			c.Field = ""
+		} else {
+			used[c.Field] = true
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// event_columns_from_form reads the mapping chosen by the operator
+func event_columns_from_form(r *http.Request, recs [][]string) []event_Column {
+
+	res := event_columns(recs, map[string]string{})
+	for ix := range res {
+		fld := r.FormValue(res[ix].Input())
+		if _, ok := find_event_field(fld); ok {
+			res[ix].Field = fld
+		}
+	}
+	return res
+}
+
+// check_event_mapping makes sure there's enough to record a ride for every line
+func check_event_mapping(cols []event_Column, ep event_Params) []string {
+
+	problems := make([]string, 0)
+	mapped := make(map[string]bool)
+	for _, c := range cols {
+		if c.Field == "" {
+			continue
+		}
+		if mapped[c.Field] {
+			f, _ := find_event_field(c.Field)
+			problems = append(problems, fmt.Sprintf("%v can only be taken from one column", f.Label))
+		}
+		mapped[c.Field] = true
+	}
+	if !mapped["RiderName"] && !mapped["RiderLast"] {
+		problems = append(problems, "Which column holds the rider's name?")
+	}
+	if !mapped["Bike"] {
+		problems = append(problems, "Which column holds the bike?")
+	}
+	if !mapped["Miles"] {
+		problems = append(problems, "Which column holds the miles ridden?")
+	}
+	if !mapped["RideDate"] && ep.RideDate == "" {
+		problems = append(problems, "Which column holds the date of the ride? Otherwise please give the date for everyone")
+	}
+	if !mapped["RideName"] && ep.RideName == "" {
+		problems = append(problems, "Which column holds the IBA ride name? Otherwise please choose the ride for everyone")
+	}
+	return problems
+}
+
+// parse_event_records turns the lines of an event file into entrants. Problems are
+// reported by row as for rally files.
+func parse_event_records(recs [][]string, cols []event_Column, ep event_Params) ([]event_Entrant, []string) {
+
+	res := make([]event_Entrant, 0, len(recs))
+	problems := make([]string, 0)
+	for rowix, ln := range recs[1:] {
+		if strings.TrimSpace(strings.Join(ln, "")) == "" {
+			continue
+		}
+		row := rowix + 2 // Numbered from 1 including the headings
+		var ee event_Entrant
+		rv := reflect.ValueOf(&ee).Elem()
+		for _, c := range cols {
+			if c.Field == "" || c.Index >= len(ln) {
+				continue
+			}
+			val := strings.TrimSpace(ln[c.Index])
+			if !set_column_value(rv, c.Field, val) {
+				f, _ := find_event_field(c.Field)
+				problems = append(problems, fmt.Sprintf("Row %v: %v '%v' is not a number", row, f.Label, val))
+			}
+		}
+		if ee.RiderName == "" {
+			ee.RiderName = strings.TrimSpace(ee.RiderFirst + " " + ee.RiderLast)
+		}
+		if ee.RiderName == "" {
+			problems = append(problems, fmt.Sprintf("Row %v: no rider name", row))
+			continue
+		}
+		if ee.RideName == "" {
+			ee.RideName = ep.RideName
+		}
+		ok := true
+		if ee.RideDate == "" {
+			ee.RideDate = ep.RideDate
+		} else if ee.RideDate, ok = event_date(ee.RideDate); !ok {
+			problems = append(problems, fmt.Sprintf("Row %v (%v): '%v' is not a date", row, ee.RiderName, ee.RideDate))
+			continue
+		}
+		if ee.FinishDate == "" {
+			ee.FinishDate = ee.RideDate
+		} else if ee.FinishDate, ok = event_date(ee.FinishDate); !ok {
+			problems = append(problems, fmt.Sprintf("Row %v (%v): '%v' is not a date", row, ee.RiderName, ee.FinishDate))
+			continue
+		}
+		if ee.FinishDate < ee.RideDate {
+			problems = append(problems, fmt.Sprintf("Row %v (%v): the ride finished before it started", row, ee.RiderName))
+			continue
+		}
+		ee.StartTime = event_time(ee.RideDate, ee.StartTime)
+		ee.FinishTime = event_time(ee.FinishDate, ee.FinishTime)
+		res = append(res, ee)
+	}
+	return res, problems
+}
+
+// event_date returns a date from an event file as yyyy-mm-dd. Dates are British, day first.
+func event_date(x string) (string, bool) {
+
+	if d := alys_date(x); d != "" {
+		return d, true
+	}
+	for _, f := range eventDateFormats {
+		if t, err := time.Parse(f, strings.TrimSpace(x)); err == nil {
+			return t.Format("2006-01-02"), true
+		}
+	}
+	return x, false
+}
+
+// event_time adds the date to a time of day so that the ride length can be worked out
+func event_time(date string, x string) string {
+
+	x = strings.TrimSpace(x)
+	if _, err := time.Parse("15:04", x); err == nil && len(x) == 5 {
+		return date + "T" + x
+	}
+	if d := alys_date(x); d != "" && len(x) == 16 {
+		return d + "T" + x[11:]
+	}
+	return x
+}
+
+// check_event_ride_names makes sure every ride is one the Rides database knows about
+func check_event_ride_names(entrants []event_Entrant) ([]string, error) {
+
+	problems := make([]string, 0)
+	checked := make(map[string]bool)
+	for _, e := range entrants {
+		if checked[e.RideName] {
+			continue
+		}
+		checked[e.RideName] = true
+		n, err := getIntegerFromDB(DBH, "SELECT count(*) FROM ridenames WHERE IBA_Ride=?", 0, e.RideName)
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			problems = append(problems, fmt.Sprintf("'%v' is not an IBA ride name in the Rides database", e.RideName))
+		}
+	}
+	return problems, nil
+}
+
+// event_template_names lists the saved templates
+func event_template_names() ([]string, error) {
+
+	rows, err := DBH.Query("SELECT TemplateName FROM rupert_event_templates ORDER BY TemplateName")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+// load_event_template returns the fields of a saved template keyed by normalized heading
+func load_event_template(name string) (map[string]string, error) {
+
+	js, err := getStringFromDB(DBH, "SELECT Mapping FROM rupert_event_templates WHERE TemplateName=?", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if js == "" {
+		return nil, fmt.Errorf("There is no template called %v", name)
+	}
+	res := make(map[string]string)
+	err = json.Unmarshal([]byte(js), &res)
+	return res, err
+}
+
+// save_event_template records the mapping of the columns with headings, replacing any
+// template of the same name
+func save_event_template(name string, cols []event_Column, savedby string) error {
+
+	m := make(map[string]string)
+	for _, c := range cols {
+		if n := normalize_heading(c.Heading); n != "" && c.Field != "" {
+			m[n] = c.Field
+		}
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sqlx := "INSERT OR REPLACE INTO rupert_event_templates (TemplateName,Mapping,SavedBy,SavedAt) VALUES(?,?,?,?)"
+	_, err = DBH.Exec(sqlx, name, string(js), savedby, time.Now().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func import_event(w http.ResponseWriter, r *http.Request) {
+
+	if !allow_methods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		load_event(w, r)
+		return
+	}
+
+	pg := import_Page{Title: "Update IBAUK Rides database with event results", Action: "/event"}
+	upload, hash, ok := read_import_upload(w, r, &pg)
+	if !ok {
+		return
+	}
+	ep, err := new_event_params(r.FormValue("eventname"), r.FormValue("ridename"), r.FormValue("ridedate"))
+	if err != nil {
+		pg.Message = err.Error()
+		render(w, "import", pg)
+		return
+	}
+	pg.Title = fmt.Sprintf("Update IBAUK Rides database with %v results", ep.EventName)
+	recs, err := read_event_file(upload)
+	if err != nil {
+		pg.Problems = []string{err.Error()}
+		render(w, "import", pg)
+		return
+	}
+	pg.Fields = import_form_fields(r, "eventname", "ridename", "ridedate")
+	pg.Fields[uploadField] = hash
+
+	// The columns are mapped by the operator, or by a saved template. Failing either
+	// the operator is asked to check our guesses.
+	var cols []event_Column
+	template := r.FormValue("template")
+	mapped := r.FormValue("mapped") != ""
+	switch {
+	case mapped:
+		cols = event_columns_from_form(r, recs)
+	case template != "":
+		m, err := load_event_template(template)
+		if err != nil {
+			pg.Problems = []string{err.Error()}
+			render(w, "import", pg)
+			return
+		}
+		cols = event_columns(recs, m)
+	default:
+		cols = event_columns(recs, nil)
+	}
+	problems := check_event_mapping(cols, ep)
+	if len(problems) > 0 || (!mapped && template == "") {
+		pg.Mapping = &event_Mapping{Columns: cols, Groups: eventFields, Template: template, Problems: problems}
+		if mapped {
+			pg.Mapping.Template = r.FormValue("savetemplate")
+		}
+		render(w, "import", pg)
+		return
+	}
+	if name := strings.TrimSpace(r.FormValue("savetemplate")); name != "" {
+		err = save_event_template(name, cols, current_user(r).Name)
+		if err != nil {
+			pg.Problems = []string{err.Error()}
+			render(w, "import", pg)
+			return
+		}
+		pg.Message = fmt.Sprintf("The column mapping has been saved as template %v", name)
+	}
+	for _, c := range cols {
+		if c.Field != "" {
+			pg.Fields[c.Input()] = c.Field
+		}
+	}
+	pg.Fields["mapped"] = "1"
+
+	entrants, problems := parse_event_records(recs, cols, ep)
+	if len(problems) == 0 {
+		problems, err = check_event_ride_names(entrants)
+		if err != nil {
+			pg.set_failure(err)
+			render(w, "import", pg)
+			return
+		}
+	}
+	if len(problems) > 0 {
+		pg.Problems = problems
+		render(w, "import", pg)
+		return
+	}
+
+	finish_import(w, r, &pg, import_Steps{
+		people: func(sess *import_Session) []match_Person {
+			return event_match_people(entrants)
+		},
+		post: func(sess *import_Session) error {
+			return post_event_entrants(sess, entrants, ep, string(upload), loaded_by(r))
+		},
+	})
+
+}
+
+func load_event(w http.ResponseWriter, r *http.Request) {
+
+	data := struct {
+		CSRF      string
+		Templates []string
+		RideNames []string
+	}{CSRF: csrf_token(r)}
+
+	var err error
+	data.Templates, err = event_template_names()
+	if err == nil {
+		data.RideNames, err = event_ride_names()
+	}
+	if err != nil {
+		pg := import_Page{Title: "Update IBAUK Rides database with event results"}
+		pg.set_failure(err)
+		render(w, "import", pg)
+		return
+	}
+	render(w, "loadevent", data)
+
+}
+
+// event_ride_names lists the IBA rides known to the Rides database
+func event_ride_names() ([]string, error) {
+
+	rows, err := DBH.Query("SELECT IBA_Ride FROM ridenames WHERE ifnull(IBA_Ride,'')<>'' ORDER BY IBA_Ride")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
+
+// new_event_params sets up an event import from the name, ride and date given
+func new_event_params(name string, ridename string, ridedate string) (event_Params, error) {
+
+	ep := event_Params{EventName: strings.TrimSpace(name), RideName: strings.TrimSpace(ridename)}
+	if ep.EventName == "" {
+		return ep, errors.New("No event name supplied")
+	}
+	if d := strings.TrimSpace(ridedate); d != "" {
+		var ok bool
+		ep.RideDate, ok = event_date(d)
+		if !ok {
+			return ep, fmt.Errorf("'%v' is not a date", d)
+		}
+	}
+	return ep, nil
+}
+
+func event_match_people(entrants []event_Entrant) []match_Person {
+
+	res := make([]rally_Entrant, 0, len(entrants))
+	for _, e := range entrants {
+		res = append(res, e.rally_Entrant)
+	}
+	return rally_match_people(res)
+}
+
+// post_event_entrants records a batch of event results
+func post_event_entrants(sess *import_Session, entrants []event_Entrant, ep event_Params, data string, loadedby string) error {
+
+	var err error
+	sess.Batch, err = start_import_batch(sess.tx, "event", ep.EventName, data, loadedby)
+	if err != nil {
+		return err
+	}
+	for ix, e := range entrants {
+		err = post_event_entrant_updates(sess, e, ep, ix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func post_event_entrant_updates(sess *import_Session, e event_Entrant, ep event_Params, ix int) error {
+
+	err := post_event_person_updates(sess, e, ep, false, ix)
+	if err != nil {
+		return import_Error{e.RiderName, err}
+	}
+	if e.PillionName != "" {
+		err = post_event_person_updates(sess, e, ep, true, ix)
+		if err != nil {
+			return import_Error{e.PillionName + " (pillion)", err}
+		}
+	}
+	return nil
+}
+
+// post_event_person_updates records the rider, or pillion, and bike as for a rally then
+// adds their ride
+func post_event_person_updates(sess *import_Session, e event_Entrant, ep event_Params, isPillion bool, ix int) error {
+
+	ridername := e.RiderName
+	pn := "N"
+	if isPillion {
+		ridername = e.PillionName
+		pn = "Y"
+	}
+	act := import_Action{Entrant: ridername}
+	if isPillion {
+		act.Entrant += " (pillion)"
+	}
+	defer func() { sess.Actions = append(sess.Actions, act) }()
+
+	riderid, bikeid, err := post_rally_rider_and_bike(sess, e.rally_Entrant, isPillion, ix, &act)
+	if err != nil {
+		return err
+	}
+
+	dupecheck := "SELECT count(*) FROM rides WHERE riderid=? AND DateRideStart=? AND IBA_Ride=?"
+	x, err := getIntegerFromDB(sess.tx, dupecheck, 0, riderid, e.RideDate, e.RideName)
+	if err != nil {
+		return err
+	}
+	if x > 0 {
+		act.Ride = "Duplicate ride skipped"
+		return nil
+	}
+
+	uri, err := allocate_id(sess.tx, "rides")
+	if err != nil {
+		return err
+	}
+	rideid, err := getIntegerFromDB(sess.tx, "SELECT recid FROM ridenames WHERE IBA_Ride=?", 0, e.RideName)
+	if err != nil {
+		return err
+	}
+	km := "N"
+	if odo_in_kms(e.KmsOdo) {
+		km = "Y"
+	}
+	hrs, mins := calc_rblr_ridelength(e.StartTime, e.FinishTime)
+
+	// A ride without its miles is recorded but kept off the Roll of Honour
+	showRoH := "Y"
+	if e.Miles <= 0 {
+		showRoH = "N"
+	}
+
+	sqlx := "INSERT INTO rides (URI,riderid,NameOnCertificate,DateRideStart,DateRideFinish,IBA_Ride,IsPillion,EventName,KmsOdo,TotalMiles,bikeid,StartPoint,FinishPoint,MidPoints,DateRcvd,RideVerifier,DateVerified,IBA_RideID,ShowRoH,StartOdo,FinishOdo,TimeStart,TimeFinish,RideHours,RideMins,VerifierNotes)"
+	sqlx += "VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+	_, err = sess.tx.Exec(sqlx, uri, riderid, ridername, e.RideDate, e.FinishDate, e.RideName, pn, ep.EventName, km, e.Miles, bikeid, e.StartPoint, e.FinishPoint, e.Via, e.FinishDate, ep.EventName, e.FinishDate, rideid, showRoH, e.StartOdo, e.FinishOdo, e.StartTime, e.FinishTime, hrs, mins, e.Notes)
+	if err != nil {
+		return err
+	}
+	err = journal_insert(sess, "rides", uri)
+	if err != nil {
+		return err
+	}
+	sess.Stats.NewRides++
+	act.Ride = fmt.Sprintf("New %v ride", e.RideName)
+	if showRoH == "N" {
+		act.Ride += ", not on the Roll of Honour without its miles"
+	}
+	return nil
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -11,10 +11,6 @@ import (
 	"time"
 )
 
-// Test for EntrantStatus
-const Finisher = 8
-const LateFinisher = 10
-
 // CSV format of Finishers exported from ScoreMaster
 type rally_Entrant struct {
 	RiderName      string
@@ -36,34 +32,9 @@ type rally_Entrant struct {
 	NoviceRider    string
 	PillionRBL     string
 	NovicePillion  string
-}
-
-type RBLR_Route struct {
-	Start    string
-	Via      string
-	Finish   string
-	RideName string
-	Miles    int
-}
-
-// These codes must match those used by Alys. As of 2024 the routes are bidirectional to minimize
-// certificate reprints so the 'via' contents need not be reorganized.
-var RBLR_Routes = map[string]RBLR_Route{
-	"A-NCW": {"Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000-NC", 1006},
-	"B-NAC": {"Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000-NA", 1006},
-	"C-SCW": {"Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000-SC", 1015},
-	"D-SAC": {"Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000-SA", 1015},
-	"E-5CW": {"Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000-5C", 504},
-	"E-5AC": {"Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000-5A", 504},
-}
-
-var RBLR_Lates = map[string]RBLR_Route{
-	"A-NCW": {"Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000+NC", 1006},
-	"B-NAC": {"Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000+NA", 1006},
-	"C-SCW": {"Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000+SC", 1015},
-	"D-SAC": {"Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000+SA", 1015},
-	"E-5CW": {"Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000+5C", 504},
-	"E-5AC": {"Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000+5A", 504},
+	KmsOdo         string // Y if the odometer reads kilometres
+	ClassName      string
+	Team           string
 }
 
 type RBLR_Person = struct {
@@ -93,7 +64,7 @@ type RBLR_Money = struct {
 
 type RBLR_Entrant = struct {
 	EntrantID            int
-	EntrantStatus        int
+	EntrantStatus        RBLR_Status
 	Rider                RBLR_Person
 	Pillion              RBLR_Person
 	NokName              string
@@ -119,30 +90,45 @@ type RBLR_Entrant = struct {
 }
 
 type RBLR_Dataset struct {
-	Filetype string
+	Filetype string // Both empty when read straight from the Alys database
 	Asat     string
 	Entrants []RBLR_Entrant
+	Database bool `json:"-"` // Read from the Alys database rather than an export
+}
+
+// rally_Params describes the rally whose results are being loaded
+type rally_Params struct {
+	Code       string // Without the year
+	Year       string // Last two digits
+	Desc       string // Title, used if the rally is new
+	StartDate  string // yyyy-mm-dd, if known
+	FinishDate string
 }
 
 type RBLR_Params struct {
-	Ridedate  string
-	EventDesc string
+	Ridedate      string
+	EventDesc     string
+	AllFinishers  bool // Include late finishers and 500 mile routes, not just IBA rides
+	Participation bool // Record everyone who started in rblr_participation
 }
 
 type Stats struct {
-	NewRiders   int
-	NewPillions int
-	NewRides    int
-	Ncw         int
-	Nac         int
-	Scw         int
-	Sac         int
-	Cw5         int
-	Ac5         int
+	NewRiders    int
+	NewPillions  int
+	NewRides     int
+	Routes       map[string]int // New rides by route code
+	LateRides    int            // New rides finished outside the time limit
+	ShortRides   int            // New rides on routes of less than 1000 miles
+	Participants int            // New rblr_participation records
 }
 
-var loadstats *Stats
-var newIBAs []string
+// import_Action records what an import did, or would do in preview, for one rider or pillion
+type import_Action struct {
+	Entrant string
+	Rider   string
+	Bike    string
+	Ride    string
+}
 
 // Calculate hours:minutes using start and finish times.
 func calc_rblr_ridelength(starttime string, finishtime string) (int, int) {
@@ -175,234 +161,621 @@ func calc_rblr_ridelength(starttime string, finishtime string) (int, int) {
 
 func import_rally(w http.ResponseWriter, r *http.Request) {
 
-	if r.FormValue("thedata") == "" {
-		load_rally(w)
+	if !allow_methods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		load_rally(w, r)
 		return
 	}
 
-	rallycode := strings.ToUpper(r.FormValue("rallycode"))
-	if rallycode == "" {
-		fmt.Fprint(w, `<p>No rallycode supplied</p>`)
+	rp := new_rally_params(r.FormValue("rallycode"), r.FormValue("rallyyear"), r.FormValue("rallydesc"))
+	pg := import_Page{Title: "Update IBAUK Rides database with rally results", Action: "/rally"}
+	upload, hash, ok := read_import_upload(w, r, &pg)
+	if !ok {
 		return
 	}
-	if getStringFromDB("SELECT RallyTitle FROM rallies WHERE RallyID='"+rallycode+"'", "") == "" {
-		rallydesc := r.FormValue("rallydesc")
-		make_new_rally(rallycode, rallydesc)
+	if rp.Code == "" {
+		pg.Message = "No rallycode supplied"
+		render(w, "import", pg)
+		return
 	}
-	yr := r.FormValue("rallyyear")
-	if len(yr) > 2 {
-		yr = yr[2:]
+	if !may_load_rally(current_user(r), rp.Code) {
+		show_forbidden(w, fmt.Sprintf("You may not load results for %v.", rp.Code))
+		return
 	}
-	entrants := parse_rally(r)
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pg.Fields = import_form_fields(r, "rallycode", "rallydesc", "rallyyear", "sheet")
+	pg.Fields[uploadField] = hash
+
+	var entrants []rally_Entrant
+	var problems []string
+	var warning string
+	switch {
+	case is_sqlite(upload):
+		var sr scoremaster_Rally
+		sr, entrants, problems = parse_scoremaster(upload)
+		warning = use_scoremaster_rally(&rp, sr)
+	case is_xlsx(upload):
+		wb, err := open_xlsx(upload)
+		if err != nil {
+			problems = []string{err.Error()}
+			break
+		}
+		// The operator says which sheet holds the results unless there's only one
+		if r.FormValue("sheet") == "" && len(wb.Sheets) > 1 {
+			pg.Title = fmt.Sprintf("Update IBAUK Rides database with %v%v results", rp.Code, rp.Year)
+			pg.Sheets = wb.Sheets
+			delete(pg.Fields, "sheet")
+			render(w, "import", pg)
+			return
+		}
+		entrants, problems = parse_rally_xlsx(wb, r.FormValue("sheet"))
+	default:
+		entrants, problems = parse_rally(decode_text(upload))
+	}
+	pg.Title = fmt.Sprintf("Update IBAUK Rides database with %v%v results", rp.Code, rp.Year)
+	if len(problems) > 0 {
+		pg.Problems = problems
+		render(w, "import", pg)
+		return
+	}
 
-	fmt.Fprint(w, htmlheader)
+	finish_import(w, r, &pg, import_Steps{
+		prepare: func(sess *import_Session) error {
+			if warning != "" {
+				sess.Warnings = append(sess.Warnings, warning)
+			}
+			return nil
+		},
+		people: func(sess *import_Session) []match_Person {
+			return rally_match_people(entrants)
+		},
+		post: func(sess *import_Session) error {
+			return post_rally_entrants(sess, entrants, rp, string(upload), loaded_by(r))
+		},
+	})
 
-	fmt.Fprintf(w, `<h1>Update IBAUK Rides database with %v%v results</h1>`, rallycode, yr)
+}
 
-	var stats Stats
-	loadstats = &stats
+// new_rally_params sets up a rally import from the code, year and title given
+func new_rally_params(code string, year string, desc string) rally_Params {
 
-	DBH.Exec("BEGIN")
-	defer DBH.Exec("COMMIT")
+	rp := rally_Params{Code: strings.ToUpper(strings.TrimSpace(code)), Year: strings.TrimSpace(year), Desc: strings.TrimSpace(desc)}
+	if len(rp.Year) > 2 {
+		rp.Year = rp.Year[2:]
+	}
+	return rp
+}
 
-	fmt.Fprint(w, `<ul>`)
-	for _, e := range entrants {
-		fmt.Fprintf(w, `<li>%v`, e.RiderName)
-		if e.PillionName != "" {
-			fmt.Fprintf(w, ` + %v`, e.PillionName)
+// post_rally_entrants records a batch of rally results, creating the rally if need be
+func post_rally_entrants(sess *import_Session, entrants []rally_Entrant, rp rally_Params, data string, loadedby string) error {
+
+	rc := rp.Code + rp.Year
+	var err error
+	sess.Batch, err = start_import_batch(sess.tx, "rally", rc, data, loadedby)
+	if err != nil {
+		return err
+	}
+
+	title, err := getStringFromDB(sess.tx, "SELECT RallyTitle FROM rallies WHERE RallyID=?", "", rp.Code)
+	if err != nil {
+		return err
+	}
+	if title == "" {
+		err = make_new_rally(sess, rp.Code, rp.Desc)
+		if err != nil {
+			return err
 		}
-		fmt.Fprint(w, `</li>`)
-		post_rally_entrant_updates(e, rallycode+yr)
 	}
-	fmt.Fprint(w, `</ul>`)
-	fmt.Fprintf(w, `</p><p><strong>%v</strong> rides added to the database</p>`, stats.NewRides)
+	err = record_rally_dates(sess, rc, rp)
+	if err != nil {
+		return err
+	}
 
-	fmt.Fprintf(w, `<p>Number of new riders <strong>%v</strong>, number of new pillions <strong>%v</strong></p>`, stats.NewRiders, stats.NewPillions)
+	for ix, e := range entrants {
+		err = post_rally_entrant_updates(sess, e, rc, ix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	fmt.Fprint(w, `<p><a href="https://rdb.ironbutt.co.uk">Return to Rides database</a>`)
+// record_rally_dates notes when this year's rally was held, if known. The rallies
+// table has one record for all the years a rally has run so dates are kept apart.
+func record_rally_dates(sess *import_Session, rc string, rp rally_Params) error {
 
+	if rp.StartDate == "" {
+		return nil
+	}
+	n, err := getIntegerFromDB(sess.tx, "SELECT count(*) FROM rally_dates WHERE RallyID=?", 0, rc)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = sess.tx.Exec("INSERT INTO rally_dates (RallyID,StartDate,FinishDate) VALUES(?,?,?)", rc, rp.StartDate, rp.FinishDate)
+	if err != nil {
+		return err
+	}
+	return journal_insert(sess, "rally_dates", rc)
 }
+
 func import_rblr(w http.ResponseWriter, r *http.Request) {
 
-	if r.FormValue("thedata") == "" {
-		load_rblr(w)
+	if !allow_methods(w, r, http.MethodGet, http.MethodPost) {
 		return
 	}
-	var rp RBLR_Params
-	rp.Ridedate = r.FormValue("saturday")
-	if rp.Ridedate == "" {
-		fmt.Fprint(w, `<p>No Saturday date supplied</p>`)
+	if r.Method != http.MethodPost {
+		load_rblr(w, r)
+		return
+	}
+
+	pg := import_Page{Title: "Update IBAUK Rides database from RBLR1000 results", Action: "/rblr"}
+	upload, hash, ok := read_import_upload(w, r, &pg)
+	if !ok {
+		return
+	}
+
+	var ds RBLR_Dataset
+	var err error
+	saturday := r.FormValue("saturday")
+	if is_sqlite(upload) {
+		var eventdate string
+		ds, eventdate, err = parse_alys(upload)
+		if err == nil {
+			saturday, err = alys_ride_date(saturday, eventdate)
+		}
+	} else {
+		ds, err = parse_rblr(decode_text(upload))
+	}
+	if err != nil {
+		pg.Problems = []string{err.Error()}
+		render(w, "import", pg)
+		return
+	}
+	entrants := ds.Entrants
+	rp, err := new_rblr_params(saturday, r.FormValue("allfinishers") != "", r.FormValue("participation") != "")
+	if err != nil {
+		pg.Message = err.Error()
+		render(w, "import", pg)
+		return
+	}
+	warnings, err := check_rblr_dataset(ds, rp.Ridedate)
+	if err != nil {
+		pg.Problems = []string{err.Error()}
+		render(w, "import", pg)
 		return
 	}
-	rp.EventDesc = "RBLR 1000 ('" + rp.Ridedate[2:4] + ")"
 
-	entrants := parse_rblr(r)
+	pg.Fields = import_form_fields(r, "saturday", "allfinishers", "participation")
+	pg.Fields["saturday"] = rp.Ridedate
+	pg.Fields[uploadField] = hash
+	finish_import(w, r, &pg, import_Steps{
+		prepare: func(sess *import_Session) error {
+			var err error
+			sess.Routes, err = rblr_routes_on(DBH, rp.Ridedate)
+			sess.Warnings = append(sess.Warnings, warnings...)
+			// Only shown alongside the results of the import
+			pg.RBLR = &rblr_Summary{Params: rp, Routes: sess.Routes, Statuses: rblr_status_counts(entrants), Entrants: len(entrants)}
+			return err
+		},
+		people: func(sess *import_Session) []match_Person {
+			return rblr_match_people(sess, rp, entrants)
+		},
+		post: func(sess *import_Session) error {
+			return post_rblr_entrants(sess, entrants, rp, string(upload), loaded_by(r))
+		},
+	})
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+}
 
-	fmt.Fprint(w, htmlheader)
+// new_rblr_params sets up an RBLR import for the ride on the Saturday given
+func new_rblr_params(saturday string, allfinishers bool, participation bool) (RBLR_Params, error) {
 
-	fmt.Fprint(w, `<h1>Update IBAUK Rides database from RBLR1000 results</h1>`)
+	var rp RBLR_Params
+	rp.Ridedate = saturday
+	if len(rp.Ridedate) < 4 {
+		return rp, errors.New("No Saturday date supplied")
+	}
+	rp.EventDesc = "RBLR 1000 ('" + rp.Ridedate[2:4] + ")"
+	rp.AllFinishers = allfinishers
+	rp.Participation = participation
+	return rp, nil
+}
+
+// post_rblr_entrants records a batch of RBLR results
+func post_rblr_entrants(sess *import_Session, entrants []RBLR_Entrant, rp RBLR_Params, data string, loadedby string) error {
 
-	DBH.Exec("BEGIN")
-	defer DBH.Exec("COMMIT")
-	var stats Stats
+	var err error
+	sess.Batch, err = start_import_batch(sess.tx, "rblr", rp.Ridedate, data, loadedby)
+	if err != nil {
+		return err
+	}
+	for ix, e := range entrants {
 
-	loadstats = &stats
-	fmt.Fprint(w, `<p>`)
-	for _, e := range entrants {
+		if _, ok := find_rblr_route(sess.Routes, e.Route); !ok && (e.EntrantStatus == Finisher || e.EntrantStatus == LateFinisher) {
+			sess.Warnings = append(sess.Warnings, fmt.Sprintf("%v %v: route '%v' is not in the catalogue so was not imported", e.Rider.First, e.Rider.Last, e.Route))
+			continue
+		}
 
 		// The file includes Finishers and Late Finishers, 1000 mile routes and 500 mile routes
-		// but for now we're only interested in IBA qualified results
-		IBAFinisher := e.EntrantStatus == Finisher && RBLR_Routes[e.Route].Miles >= 1000
-		if !IBAFinisher {
+		// but unless asked we're only interested in IBA qualified results
+		if !rblr_wanted(sess, rp, e) {
 			continue
 		}
-		//fmt.Fprintf(w, `%v &nbsp; `, e.Rider.Last+",&nbsp;"+e.Rider.First)
-		post_rblr_entrant_updates(e, rp)
+		err = post_rblr_entrant_updates(sess, e, rp, ix)
+		if err != nil {
+			return err
+		}
+	}
+	if rp.Participation {
+		return post_rblr_participation(sess, entrants, rp)
 	}
-	fmt.Fprintf(w, `</p><p><strong>%v</strong> rides added to the database</p>`, stats.NewRides)
+	return nil
+}
 
-	fmt.Fprintf(w, `<p>Number of new riders <strong>%v</strong>, number of new pillions <strong>%v</strong></p>`, stats.NewRiders, stats.NewPillions)
-	fmt.Fprintf(w, `<p>NCW: <strong>%v</strong>&nbsp;  NAC: <strong>%v</strong>&nbsp;  SCW: <strong>%v</strong>&nbsp;  SAC: <strong>%v</strong>&nbsp; </p>`, stats.Ncw, stats.Nac, stats.Scw, stats.Sac)
+// import_Error identifies the entrant being processed when an import failed
+type import_Error struct {
+	Entrant string
+	Err     error
+}
 
-	fmt.Fprint(w, `<p>New IBA members</p><ol>`)
-	for _, x := range newIBAs {
-		fmt.Fprintf(w, `<li>%v</li>`, x)
+func (e import_Error) Error() string {
+	return e.Entrant + ": " + e.Err.Error()
+}
+
+func (e import_Error) Unwrap() error {
+	return e.Err
+}
+
+// import_Page holds everything shown by the import pages: a reason the file can't be
+// imported, choices for the operator, or the results of the import or preview.
+type import_Page struct {
+	Title         string
+	Message       string
+	Problems      []string
+	Failure       string
+	FailedEntrant string
+	Action        string            // where the page's forms are posted
+	Fields        map[string]string // carried forward by the page's forms
+	Reconcile     []rider_Ambiguity
+	Sheets        []string        // of a workbook, for the operator to choose from
+	Mapping       *event_Mapping  // of an event file's columns, for the operator to check
+	Session       *import_Session // once the import has run
+	RBLR          *rblr_Summary
+}
+
+// rblr_Summary adds the RBLR specific figures to an import page
+type rblr_Summary struct {
+	Params   RBLR_Params
+	Routes   []RBLR_Route
+	Statuses []status_Count
+	Entrants int
+}
+
+// read_import_upload fetches the results file posted to an import page, showing the
+// page with the reason if there isn't one.
+func read_import_upload(w http.ResponseWriter, r *http.Request, pg *import_Page) ([]byte, string, bool) {
+
+	upload, hash, err := read_upload(r)
+	if err != nil {
+		pg.Problems = []string{err.Error()}
+		render(w, "import", pg)
+		return nil, "", false
+	}
+	if upload == nil {
+		pg.Message = "No results file supplied"
+		render(w, "import", pg)
+		return nil, "", false
 	}
-	fmt.Fprint(w, `</ol>`)
-	fmt.Fprint(w, `<p><a href="https://rdb.ironbutt.co.uk">Return to Rides database</a>`)
+	return upload, hash, true
+}
 
+// import_Steps are what an importer adds to finish_import. prepare, if given, is called
+// once the session has started; people lists those who may need reconciling and post
+// records the entrants.
+type import_Steps struct {
+	prepare func(*import_Session) error
+	people  func(*import_Session) []match_Person
+	post    func(*import_Session) error
 }
 
-func load_rally(w http.ResponseWriter) {
+// finish_import is the common end of every import page. Any riders who can't be matched
+// for certain are put to the operator first, then the results shown.
+func finish_import(w http.ResponseWriter, r *http.Request, pg *import_Page, steps import_Steps) {
+
+	sess, err := new_import_session(r.FormValue("preview") != "", parse_resolutions(r))
+	if err == nil && steps.prepare != nil {
+		err = steps.prepare(sess)
+	}
+	if err != nil {
+		pg.set_failure(err)
+		render(w, "import", pg)
+		return
+	}
+	if !sess.Preview && r.FormValue("reconciled") == "" {
+		pg.Reconcile = find_ambiguities(sess, steps.people(sess))
+		if len(pg.Reconcile) > 0 {
+			render(w, "import", pg)
+			return
+		}
+	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The whole file is loaded, or previewed, in a single transaction. A preview runs
+	// exactly the same updates as a real import then rolls them back.
+	err = run_import(sess, steps.post)
+	if err != nil {
+		pg.set_failure(err)
+	} else {
+		pg.Session = sess
+	}
+	render(w, "import", pg)
+}
 
-	fmt.Fprint(w, htmlheader)
+// set_failure reports an error which stopped an import part way through
+func (pg *import_Page) set_failure(err error) {
 
-	sqlx := "SELECT RallyID,RallyTitle FROM rallies ORDER BY RallyID"
-	options := ""
-
-	rallies, err := DBH.Query(sqlx)
-	checkerr(err)
-	defer rallies.Close()
-	var rally string
-	var title string
-	for rallies.Next() {
-		err = rallies.Scan(&rally, &title)
-		checkerr(err)
-		opt := fmt.Sprintf(`<option value="%v">%v</option>`, rally, title)
-		options += opt
-	}
-	const rallyopts = "<!-- options -->"
-	const minyear = "<!-- min -->"
-	const maxyear = "<!-- max -->"
-	const curyear = "<!-- value -->"
-	yr := time.Now().Year()
-	x := strings.Replace(loadrallyform, rallyopts, options, 1)
-	x = strings.Replace(x, curyear, strconv.Itoa(yr), 1)
-	x = strings.Replace(x, maxyear, strconv.Itoa(yr), 1)
-	x = strings.Replace(x, minyear, strconv.Itoa(yr-2), 1)
-	fmt.Fprint(w, x)
+	var ie import_Error
+	if errors.As(err, &ie) {
+		pg.FailedEntrant = ie.Entrant
+		err = ie.Err
+	}
+	pg.Failure = err.Error()
+}
+
+// import_form_fields collects the named form values, together with any reconciliation
+// choices, so that they can be carried forward by a later form.
+func import_form_fields(r *http.Request, names ...string) map[string]string {
 
+	res := make(map[string]string)
+	for _, n := range names {
+		res[n] = r.FormValue(n)
+	}
+	for k, v := range parse_resolutions(r) {
+		if v == 0 {
+			res[matchFieldPrefix+k] = "new"
+		} else {
+			res[matchFieldPrefix+k] = strconv.FormatInt(v, 10)
+		}
+	}
+	if r.FormValue("reconciled") != "" {
+		res["reconciled"] = r.FormValue("reconciled")
+	}
+	res[csrfField] = csrf_token(r)
+	return res
 }
-func load_rblr(w http.ResponseWriter) {
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+func load_rally(w http.ResponseWriter, r *http.Request) {
 
-	fmt.Fprint(w, htmlheader)
+	type rally struct {
+		Code  string
+		Title string
+	}
+	user := current_user(r)
+	yr := time.Now().Year()
+	data := struct {
+		CSRF    string
+		Rallies []rally
+		Year    int
+		MinYear int
+	}{CSRF: csrf_token(r), Year: yr, MinYear: yr - 2}
 
-	fmt.Fprint(w, loadrblrform)
+	sqlx := "SELECT RallyID,RallyTitle FROM rallies ORDER BY RallyID"
+	rows, err := DBH.Query(sqlx)
+	if err != nil {
+		pg := import_Page{Title: "Update IBAUK Rides database from rally results"}
+		pg.set_failure(err)
+		render(w, "import", pg)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x rally
+		err = rows.Scan(&x.Code, &x.Title)
+		if err != nil {
+			break
+		}
+		if may_load_rally(user, x.Code) {
+			data.Rallies = append(data.Rallies, x)
+		}
+	}
+	render(w, "loadrally", data)
 
 }
+func load_rblr(w http.ResponseWriter, r *http.Request) {
 
-func parse_rally(r *http.Request) []rally_Entrant {
+	render(w, "loadrblr", struct{ CSRF string }{csrf_token(r)})
+
+}
+
+// parse_rally reads a ScoreMaster finishers CSV
+func parse_rally(cdata string) ([]rally_Entrant, []string) {
 
-	cdata := r.FormValue("thedata")
 	if cdata == "" {
-		return []rally_Entrant{}
+		return []rally_Entrant{}, []string{}
 	}
 	rdr := csv.NewReader(strings.NewReader(cdata))
+	rdr.FieldsPerRecord = -1
 
 	recs, err := rdr.ReadAll()
-	checkerr(err)
+	if err != nil {
+		return []rally_Entrant{}, []string{err.Error()}
+	}
 
-	res := make([]rally_Entrant, 0, len(recs))
+	return parse_rally_records(recs)
 
-	skip := true
-	for _, ln := range recs {
-		if skip {
-			skip = false
-			continue
-		}
-		var re rally_Entrant
-		re.RiderName = ln[0]
-		re.PillionName = ln[1]
-		re.Bike = ln[2]
-		re.Placing = intval(ln[3])
-		re.Miles = intval(ln[4])
-		re.Points = intval(ln[5])
-		re.RiderIBA = intval(ln[6])
-		re.PillionIBA = intval(ln[7])
-		re.BikeReg = ln[8]
-		re.Class = intval(ln[9])
-		re.Phone = ln[10]
-		re.Email = ln[11]
-		re.Postcode = ln[12]
-		re.Country = ln[13]
-		re.Postal_Address = ln[14]
-		re.RiderRBL = ln[15]
-		re.NoviceRider = ln[16]
-		re.NovicePillion = ln[17]
-		res = append(res, re)
-		fmt.Printf("0=%v, 1=%v, pa={ %v }\n", ln[0], ln[1], re.Postal_Address)
+}
+
+func rally_match_people(entrants []rally_Entrant) []match_Person {
 
+	res := make([]match_Person, 0, len(entrants))
+	for ix, e := range entrants {
+		p := match_Person{Key: match_key(ix, false), Name: e.RiderName, Email: e.Email, Phone: e.Phone, Postcode: e.Postcode}
+		if e.RiderIBA > 0 {
+			p.IBA = strconv.Itoa(e.RiderIBA)
+		}
+		res = append(res, p)
+		if e.PillionName != "" {
+			p = match_Person{Key: match_key(ix, true), Name: e.PillionName}
+			if e.PillionIBA > 0 {
+				p.IBA = strconv.Itoa(e.PillionIBA)
+			}
+			res = append(res, p)
+		}
 	}
+	return res
+}
+
+func rblr_match_people(sess *import_Session, rp RBLR_Params, entrants []RBLR_Entrant) []match_Person {
 
+	res := make([]match_Person, 0, len(entrants))
+	for ix, e := range entrants {
+		if !rblr_wanted(sess, rp, e) {
+			continue
+		}
+		res = append(res, rblr_match_person(e.Rider, match_key(ix, false)))
+		if e.Pillion.First != "" || e.Pillion.Last != "" || e.Pillion.IBA != "" {
+			res = append(res, rblr_match_person(e.Pillion, match_key(ix, true)))
+		}
+	}
 	return res
+}
+
+// rblr_iba_finisher is true if e finished a 1000 mile route within 24 hours
+func rblr_iba_finisher(sess *import_Session, e RBLR_Entrant) bool {
 
+	rt, ok := find_rblr_route(sess.Routes, e.Route)
+	return ok && e.EntrantStatus == Finisher && rt.Miles >= 1000
 }
-func parse_rblr(r *http.Request) []RBLR_Entrant {
 
-	res := make([]RBLR_Entrant, 0)
-	jdata := r.FormValue("thedata")
-	if jdata == "" {
-		return res
+// rblr_wanted is true if e should be recorded by this import
+func rblr_wanted(sess *import_Session, rp RBLR_Params, e RBLR_Entrant) bool {
+
+	if rblr_iba_finisher(sess, e) {
+		return true
 	}
-	var rblr RBLR_Dataset
-	err := json.Unmarshal([]byte(jdata), &rblr)
-	checkerr(err)
+	_, ok := find_rblr_route(sess.Routes, e.Route)
+	return ok && rp.AllFinishers && (e.EntrantStatus == Finisher || e.EntrantStatus == LateFinisher)
+}
+
+func rblr_match_person(p RBLR_Person, key string) match_Person {
 
-	return rblr.Entrants
+	return match_Person{Key: key, Name: p.First + " " + p.Last, IBA: strings.TrimSpace(p.IBA), Email: p.Email, Phone: p.Phone, Postcode: p.Postcode}
 }
 
-func make_new_rally(code string, desc string) {
+func make_new_rally(sess *import_Session, code string, desc string) error {
 
 	sqlx := "INSERT INTO rallies (RallyID,RallyTitle) VALUES(?,?)"
-	stmt, err := DBH.Prepare(sqlx)
-	checkerr(err)
+	stmt, err := sess.tx.Prepare(sqlx)
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
 	_, err = stmt.Exec(code, desc)
-	checkerr(err)
+	if err != nil {
+		return err
+	}
+	err = journal_insert(sess, "rallies", code)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func post_rally_entrant_updates(e rally_Entrant, rc string) {
+func post_rally_entrant_updates(sess *import_Session, e rally_Entrant, rc string, ix int) error {
 
-	post_rally_person_updates(e, rc, false)
+	err := post_rally_person_updates(sess, e, rc, false, ix)
+	if err != nil {
+		return import_Error{e.RiderName, err}
+	}
 	if e.PillionName != "" {
-		post_rally_person_updates(e, rc, true)
+		err = post_rally_person_updates(sess, e, rc, true, ix)
+		if err != nil {
+			return import_Error{e.PillionName + " (pillion)", err}
+		}
 	}
+	return nil
 }
 
-func post_rally_person_updates(e rally_Entrant, rc string, isPillion bool) {
+func post_rally_person_updates(sess *import_Session, e rally_Entrant, rc string, isPillion bool, ix int) error {
+
+	act := import_Action{Entrant: e.RiderName}
+	if isPillion {
+		act.Entrant = e.PillionName + " (pillion)"
+	}
+	defer func() { sess.Actions = append(sess.Actions, act) }()
+
+	riderid, bikeid, err := post_rally_rider_and_bike(sess, e, isPillion, ix, &act)
+	if err != nil {
+		return err
+	}
+
+	dupecheck := "SELECT recid FROM rallyresults WHERE riderid=? AND bikeid=? AND RallyID=?"
+	x, err := getIntegerFromDB(sess.tx, dupecheck, 0, riderid, bikeid, rc)
+	if err != nil {
+		return err
+	}
+	if x > 0 {
+		//fmt.Println("Ride is duplicated")
+		act.Ride = "Duplicate ride skipped"
+		return nil
+	}
+
+	uri, err := allocate_id(sess.tx, "rallyresults")
+	if err != nil {
+		return err
+	}
+	sqlx := "INSERT INTO rallyresults (recid,RallyID,FinishPosition,riderid,bikeid,RallyMiles,RallyPoints,Country)"
+	sqlx += "VALUES(?,?,?,?,?,?,?,?)"
+	//fmt.Println(sqlx)
+	stmt, err := sess.tx.Prepare(sqlx)
+	if err != nil {
+		return err
+	}
+	//fmt.Println("All good")
+	defer stmt.Close()
+	_, err = stmt.Exec(uri, rc, e.Placing, riderid, bikeid, e.Miles, e.Points, e.Country)
+	if err != nil {
+		return err
+	}
+	err = journal_insert(sess, "rallyresults", uri)
+	if err != nil {
+		return err
+	}
+	err = record_rally_class(sess, uri, e)
+	if err != nil {
+		return err
+	}
+	sess.Stats.NewRides++
+	act.Ride = fmt.Sprintf("New %v result", rc)
+
+	return nil
+}
+
+// record_rally_class keeps an entrant's class and team alongside their result. The
+// rallyresults table belongs to the Rides database so they live in a table of Rupert's.
+func record_rally_class(sess *import_Session, recid int64, e rally_Entrant) error {
+
+	if e.ClassName == "" && e.Team == "" {
+		return nil
+	}
+	_, err := sess.tx.Exec("INSERT INTO rallyresult_classes (recid,ClassName,Team) VALUES(?,?,?)", recid, e.ClassName, e.Team)
+	if err != nil {
+		return err
+	}
+	return journal_insert(sess, "rallyresult_classes", recid)
+}
+
+// post_rally_rider_and_bike finds or creates the riders record of an entrant, or their
+// pillion, and the bike they rode. It's shared by every importer whose entrants are
+// given as a rally_Entrant.
+func post_rally_rider_and_bike(sess *import_Session, e rally_Entrant, isPillion bool, ix int, act *import_Action) (int64, int64, error) {
 
 	var riderid int64
 	var bikeid int64
+	var err error
 
-	// Unique IDs in the Rides database are not autogenerated, we must calculate and supply
+	// Unique IDs in the Rides database are not autogenerated, we must allocate and supply
 
 	var ridername string
 	var iba int
@@ -420,145 +793,182 @@ func post_rally_person_updates(e rally_Entrant, rc string, isPillion bool) {
 	ad := time.Now().Format("2006-01-02")
 	pa := transform_rally_address(e.Postal_Address)
 
+	mp := match_Person{Key: match_key(ix, isPillion), Name: ridername}
 	if iba > 0 {
-		riderid = getIntegerFromDB("SELECT riderid FROM riders WHERE IBA_Number='"+strconv.Itoa(iba)+"'", 0)
+		mp.IBA = strconv.Itoa(iba)
 	}
-	if riderid == 0 {
-		riderid = getIntegerFromDB("SELECT riderid FROM riders WHERE Rider_Name='"+ridername+"'", 0)
+	if !isPillion {
+		mp.Email = e.Email
+		mp.Phone = e.Phone
+		mp.Postcode = e.Postcode
+	}
+	riderid, act.Rider, err = resolve_rider(sess, mp)
+	if err != nil {
+		return 0, 0, err
 	}
 	if riderid == 0 { // Must create new record
-		riderid = getIntegerFromDB("SELECT max(riderid) FROM riders", 0) + 1
+		riderid, err = allocate_id(sess.tx, "riders")
+		if err != nil {
+			return 0, 0, err
+		}
 		sqlx := "INSERT INTO riders (riderid,Rider_Name,IBA_Number,Postal_Address,Postcode,Country,Email,Phone,IsPillion,DateLastActive)"
-		sqlx += "VALUES("
-		sqlx += fmt.Sprintf("%v,'%v','%v',%v,'%v','%v','%v','%v','%v','%v'", riderid, ridername, iba, pa, e.Postcode, e.Country, e.Email, e.Phone, pn, ad)
-		sqlx += ")"
-		newIBAs = append(newIBAs, ridername)
+		sqlx += "VALUES(?,?,?,?,?,?,?,?,?,?)"
+		sess.NewIBAs = append(sess.NewIBAs, ridername)
 		//fmt.Println(sqlx)
-		_, err := DBH.Exec(sqlx)
-		checkerr(err)
+		_, err = sess.tx.Exec(sqlx, riderid, ridername, strconv.Itoa(iba), pa, e.Postcode, e.Country, e.Email, e.Phone, pn, ad)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = journal_insert(sess, "riders", riderid)
+		if err != nil {
+			return 0, 0, err
+		}
+		add_to_rider_index(sess, riderid, mp)
 		if pn == "Y" {
-			loadstats.NewPillions++
+			sess.Stats.NewPillions++
 		} else {
-			loadstats.NewRiders++
+			sess.Stats.NewRiders++
 		}
+		act.Rider = fmt.Sprintf("New rider (rider %v)", riderid)
 	} else {
-		sqlx := "UPDATE riders SET DateLastActive='" + ad + "',Postal_Address=" + pa + ",Postcode='" + e.Postcode + "',Country='" + e.Country + "',Email='" + e.Email + "',Phone='" + e.Phone + "' WHERE riderid=" + fmt.Sprintf("%v", riderid)
+		cols, vals := rider_contact_updates(e)
+		cols = append([]string{"DateLastActive"}, cols...)
+		vals = append([]any{ad}, vals...)
+		err = journal_update(sess, "riders", riderid, cols)
+		if err != nil {
+			return 0, 0, err
+		}
+		sqlx := "UPDATE riders SET " + strings.Join(cols, "=?,") + "=? WHERE riderid=?"
 		//fmt.Println(sqlx)
-		_, err := DBH.Exec(sqlx)
-		checkerr(err)
+		_, err = sess.tx.Exec(sqlx, append(vals, riderid)...)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	bikeid, err = getIntegerFromDB(sess.tx, "SELECT bikeid FROM bikes WHERE riderid=? AND Bike=? AND (ifnull(Registration,'')=? OR ifnull(Registration,'')='')", 0, riderid, e.Bike, e.BikeReg)
+	if err != nil {
+		return 0, 0, err
 	}
-	bikeid = getIntegerFromDB(fmt.Sprintf("SELECT bikeid FROM bikes WHERE riderid=%v AND Bike='%v' AND (ifnull(Registration,'')='%v' OR ifnull(Registration,'')='')", riderid, e.Bike, e.BikeReg), 0)
 
 	// Switch for bike odo is Y=kms, N=miles
 	km := "N"
-	// Switch not available in Finisher export from ScoreMaster
+	if odo_in_kms(e.KmsOdo) {
+		km = "Y"
+	}
 
 	if bikeid == 0 {
-		bikeid = getIntegerFromDB("SELECT max(bikeid) FROM bikes", 0) + 1
+		bikeid, err = allocate_id(sess.tx, "bikes")
+		if err != nil {
+			return 0, 0, err
+		}
 		sqlx := "INSERT INTO bikes (bikeid,riderid,KmsOdo,Bike,Registration) VALUES(?,?,?,?,?)"
-		stmt, err := DBH.Prepare(sqlx)
-		checkerr(err)
+		stmt, err := sess.tx.Prepare(sqlx)
+		if err != nil {
+			return 0, 0, err
+		}
 		defer stmt.Close()
 		_, err = stmt.Exec(bikeid, riderid, km, e.Bike, e.BikeReg)
-		checkerr(err)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = journal_insert(sess, "bikes", bikeid)
+		if err != nil {
+			return 0, 0, err
+		}
 		//fmt.Printf("New bike inserted %v\n", bikeid)
+		act.Bike = fmt.Sprintf("New bike %v", e.Bike)
 	} else {
+		err = journal_update(sess, "bikes", bikeid, []string{"KmsOdo", "Registration"})
+		if err != nil {
+			return 0, 0, err
+		}
 		sqlx := "UPDATE bikes SET KmsOdo=?,Registration=? WHERE riderid=? AND bikeid=? AND ifnull(Registration,'')=''"
-		stmt, err := DBH.Prepare(sqlx)
-		checkerr(err)
+		stmt, err := sess.tx.Prepare(sqlx)
+		if err != nil {
+			return 0, 0, err
+		}
 		defer stmt.Close()
 		_, err = stmt.Exec(km, e.BikeReg, riderid, bikeid)
-		checkerr(err)
+		if err != nil {
+			return 0, 0, err
+		}
 		//fmt.Printf("Bike %v updated\n", bikeid)
+		act.Bike = fmt.Sprintf("Existing bike %v", e.Bike)
 	}
-
-	dupecheck := fmt.Sprintf("SELECT recid FROM rallyresults WHERE riderid=%v AND bikeid=%v AND RallyID='%v'", riderid, bikeid, rc)
-	x := getIntegerFromDB(dupecheck, 0)
-	if x > 0 {
-		//fmt.Println("Ride is duplicated")
-		return
-	}
-
-	uri := getIntegerFromDB("SELECT max(recid) FROM rallyresults", 0) + 1
-	sqlx := "INSERT INTO rallyresults (recid,RallyID,FinishPosition,riderid,bikeid,RallyMiles,RallyPoints,Country)"
-	sqlx += "VALUES(?,?,?,?,?,?,?,?)"
-	//fmt.Println(sqlx)
-	stmt, err := DBH.Prepare(sqlx)
-	checkerr(err)
-	//fmt.Println("All good")
-	defer stmt.Close()
-	_, err = stmt.Exec(uri, rc, e.Placing, riderid, bikeid, e.Miles, e.Points, e.Country)
-	checkerr(err)
-	loadstats.NewRides++
-
+	return riderid, bikeid, nil
 }
 
 // This is where database updates are executed for successful RBLR rides
-func post_rblr_entrant_updates(e RBLR_Entrant, rp RBLR_Params) {
+func post_rblr_entrant_updates(sess *import_Session, e RBLR_Entrant, rp RBLR_Params, ix int) error {
 
-	post_rblr_person_updates(e, rp, false)
+	err := post_rblr_person_updates(sess, e, rp, false, ix)
+	if err != nil {
+		return import_Error{e.Rider.First + " " + e.Rider.Last, err}
+	}
 	if e.Pillion.First != "" || e.Pillion.Last != "" || e.Pillion.IBA != "" {
-		post_rblr_person_updates(e, rp, true)
+		err = post_rblr_person_updates(sess, e, rp, true, ix)
+		if err != nil {
+			return import_Error{e.Pillion.First + " " + e.Pillion.Last + " (pillion)", err}
+		}
 	}
+	return nil
+}
 
+// transform_rally_address turns the " | " separated lines of a ScoreMaster address into
+// the multi-line form used in the Rides database
+// rider_contact_updates lists the contact details a file gives for a rider already on
+// file. Details the file left blank, or had no column for, are left as they are.
+func rider_contact_updates(e rally_Entrant) ([]string, []any) {
+
+	cols := make([]string, 0)
+	vals := make([]any, 0)
+	for _, c := range []struct {
+		col string
+		val string
+	}{
+		{"Postal_Address", transform_rally_address(e.Postal_Address)},
+		{"Postcode", e.Postcode},
+		{"Country", e.Country},
+		{"Email", e.Email},
+		{"Phone", e.Phone},
+	} {
+		if strings.TrimSpace(c.val) != "" {
+			cols = append(cols, c.col)
+			vals = append(vals, c.val)
+		}
+	}
+	return cols, vals
 }
 
 func transform_rally_address(address string) string {
 
-	// We want to store the address over multiple lines BUT
-	// SQLite can't handle escaped chars directly, only via
-	// its concatenate function which isn't handled correctly
-	// by Prepare/Exec handlers.
-
-	const nl = " || char(13) || char(10) ||"
 	pax := strings.Split(address, " | ")
-
-	pa := ""
-	if len(pax) > 1 {
-		pa = "'" + address + "'"
-		return pa
+	for ix := range pax {
+		pax[ix] = strings.TrimSpace(pax[ix])
 	}
-
-	for ix := 0; ix < len(pax); ix++ {
-		if ix > 0 {
-			pa += nl
-		}
-		pa += "'" + strings.TrimSpace(pax[ix]) + "'"
-
-	}
-
-	return pa
+	return strings.Join(pax, "\r\n")
 
 }
 
 func transform_rblr_address(p RBLR_Person) string {
 
-	// We want to store the address over multiple lines BUT
-	// SQLite can't handle escaped chars directly, only via
-	// its concatenate function which isn't handled correctly
-	// by Prepare/Exec handlers.
-	const nl = " || char(13) || char(10) ||"
-	pa := "'" + safesql(p.Address1) + "'"
-	if strings.TrimSpace(p.Address2) != "" {
-		pa += nl + "'" + safesql(p.Address2) + "'"
-	}
-	if strings.TrimSpace(p.Town) != "" {
-		pa += nl + "'" + safesql(p.Town) + "'"
-	}
-	if strings.TrimSpace(p.County) != "" {
-		pa += nl + "'" + safesql(p.County) + "'"
+	pa := []string{strings.TrimSpace(p.Address1)}
+	for _, x := range []string{p.Address2, p.Town, p.County} {
+		if strings.TrimSpace(x) != "" {
+			pa = append(pa, strings.TrimSpace(x))
+		}
 	}
-
-	return pa
+	return strings.Join(pa, "\r\n")
 
 }
 
-func post_rblr_person_updates(e RBLR_Entrant, rp RBLR_Params, isPillion bool) {
+func post_rblr_person_updates(sess *import_Session, e RBLR_Entrant, rp RBLR_Params, isPillion bool, ix int) error {
 
 	var riderid int64
 	var bikeid int64
+	var err error
 
-	// Unique IDs in the Rides database are not autogenerated, we must calculate and supply
+	// Unique IDs in the Rides database are not autogenerated, we must allocate and supply
 
 	p := e.Rider
 	pn := "N"
@@ -571,40 +981,61 @@ func post_rblr_person_updates(e RBLR_Entrant, rp RBLR_Params, isPillion bool) {
 	//fmt.Println(ridername)
 	pa := transform_rblr_address(p)
 
-	if strings.TrimSpace(p.IBA) != "" {
-		riderid = getIntegerFromDB("SELECT riderid FROM riders WHERE IBA_Number='"+strings.TrimSpace(p.IBA)+"'", 0)
+	act := import_Action{Entrant: ridername}
+	if isPillion {
+		act.Entrant += " (pillion)"
 	}
-	if riderid == 0 {
-		riderid = getIntegerFromDB("SELECT riderid FROM riders WHERE Rider_Name='"+p.First+" "+p.Last+"'", 0)
+	defer func() { sess.Actions = append(sess.Actions, act) }()
+
+	mp := rblr_match_person(p, match_key(ix, isPillion))
+	riderid, act.Rider, err = resolve_rider(sess, mp)
+	if err != nil {
+		return err
 	}
 	if riderid == 0 { // Must create new record
-		riderid = getIntegerFromDB("SELECT max(riderid) FROM riders", 0) + 1
+		riderid, err = allocate_id(sess.tx, "riders")
+		if err != nil {
+			return err
+		}
 		sqlx := "INSERT INTO riders (riderid,Rider_Name,IBA_Number,Postal_Address,Postcode,Country,Email,Phone,IsPillion,DateLastActive,Address1,Address2,Town,County,Rider_First,Rider_Last)"
-		sqlx += "VALUES("
-		sqlx += fmt.Sprintf("%v,'%v','%v',%v,'%v','%v','%v','%v','%v','%v','%v','%v','%v','%v','%v','%v'", riderid, ridername, p.IBA, pa, p.Postcode, p.Country, p.Email, p.Phone, pn, rp.Ridedate, safesql(p.Address1), safesql(p.Address2), safesql(p.Town), safesql(p.County), safesql(p.First), safesql(p.Last))
-		sqlx += ")"
-
-		IBAFinisher := e.EntrantStatus == Finisher && RBLR_Routes[e.Route].Miles >= 1000
+		sqlx += "VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 
-		if IBAFinisher {
-			newIBAs = append(newIBAs, ridername)
+		if rblr_iba_finisher(sess, e) {
+			sess.NewIBAs = append(sess.NewIBAs, ridername)
 		}
 
 		//fmt.Println(sqlx)
-		_, err := DBH.Exec(sqlx)
-		checkerr(err)
+		_, err = sess.tx.Exec(sqlx, riderid, ridername, p.IBA, pa, p.Postcode, p.Country, p.Email, p.Phone, pn, rp.Ridedate, strings.TrimSpace(p.Address1), strings.TrimSpace(p.Address2), strings.TrimSpace(p.Town), strings.TrimSpace(p.County), strings.TrimSpace(p.First), strings.TrimSpace(p.Last))
+		if err != nil {
+			return err
+		}
+		err = journal_insert(sess, "riders", riderid)
+		if err != nil {
+			return err
+		}
+		add_to_rider_index(sess, riderid, mp)
 		if pn == "Y" {
-			loadstats.NewPillions++
+			sess.Stats.NewPillions++
 		} else {
-			loadstats.NewRiders++
+			sess.Stats.NewRiders++
 		}
+		act.Rider = fmt.Sprintf("New rider (rider %v)", riderid)
 	} else {
-		sqlx := "UPDATE riders SET DateLastActive='" + rp.Ridedate + "',Postal_Address=" + pa + ",Postcode='" + p.Postcode + "',Country='" + p.Country + "',Email='" + p.Email + "',Phone='" + p.Phone + "', Address1='" + safesql(p.Address1) + "',Address2='" + safesql(p.Address2) + "',Town='" + safesql(p.Town) + "',County='" + safesql(p.County) + "',Rider_First='" + safesql(p.First) + "',Rider_Last='" + safesql(p.Last) + "' WHERE riderid=" + fmt.Sprintf("%v", riderid)
+		err = journal_update(sess, "riders", riderid, []string{"DateLastActive", "Postal_Address", "Postcode", "Country", "Email", "Phone", "Address1", "Address2", "Town", "County", "Rider_First", "Rider_Last"})
+		if err != nil {
+			return err
+		}
+		sqlx := "UPDATE riders SET DateLastActive=?,Postal_Address=?,Postcode=?,Country=?,Email=?,Phone=?,Address1=?,Address2=?,Town=?,County=?,Rider_First=?,Rider_Last=? WHERE riderid=?"
 		//fmt.Println(sqlx)
-		_, err := DBH.Exec(sqlx)
-		checkerr(err)
+		_, err = sess.tx.Exec(sqlx, rp.Ridedate, pa, p.Postcode, p.Country, p.Email, p.Phone, strings.TrimSpace(p.Address1), strings.TrimSpace(p.Address2), strings.TrimSpace(p.Town), strings.TrimSpace(p.County), strings.TrimSpace(p.First), strings.TrimSpace(p.Last), riderid)
+		if err != nil {
+			return err
+		}
+	}
+	bikeid, err = getIntegerFromDB(sess.tx, "SELECT bikeid FROM bikes WHERE riderid=? AND Bike=? AND (ifnull(Registration,'')=? OR ifnull(Registration,'')='')", 0, riderid, e.Bike, e.BikeReg)
+	if err != nil {
+		return err
 	}
-	bikeid = getIntegerFromDB(fmt.Sprintf("SELECT bikeid FROM bikes WHERE riderid=%v AND Bike='%v' AND (ifnull(Registration,'')='%v' OR ifnull(Registration,'')='')", riderid, e.Bike, e.BikeReg), 0)
 
 	// Switch for bike odo is Y=kms, N=miles
 	km := "N"
@@ -613,80 +1044,100 @@ func post_rblr_person_updates(e RBLR_Entrant, rp RBLR_Params, isPillion bool) {
 	}
 
 	if bikeid == 0 {
-		bikeid = getIntegerFromDB("SELECT max(bikeid) FROM bikes", 0) + 1
+		bikeid, err = allocate_id(sess.tx, "bikes")
+		if err != nil {
+			return err
+		}
 		sqlx := "INSERT INTO bikes (bikeid,riderid,KmsOdo,Bike,Registration) VALUES(?,?,?,?,?)"
-		stmt, err := DBH.Prepare(sqlx)
-		checkerr(err)
+		stmt, err := sess.tx.Prepare(sqlx)
+		if err != nil {
+			return err
+		}
 		defer stmt.Close()
 		_, err = stmt.Exec(bikeid, riderid, km, e.Bike, e.BikeReg)
-		checkerr(err)
+		if err != nil {
+			return err
+		}
+		err = journal_insert(sess, "bikes", bikeid)
+		if err != nil {
+			return err
+		}
 		//fmt.Printf("New bike inserted %v\n", bikeid)
+		act.Bike = fmt.Sprintf("New bike %v", e.Bike)
 	} else {
+		err = journal_update(sess, "bikes", bikeid, []string{"KmsOdo", "Registration"})
+		if err != nil {
+			return err
+		}
 		sqlx := "UPDATE bikes SET KmsOdo=?,Registration=? WHERE riderid=? AND bikeid=? AND ifnull(Registration,'')=''"
-		stmt, err := DBH.Prepare(sqlx)
-		checkerr(err)
+		stmt, err := sess.tx.Prepare(sqlx)
+		if err != nil {
+			return err
+		}
 		defer stmt.Close()
 		_, err = stmt.Exec(km, e.BikeReg, riderid, bikeid)
-		checkerr(err)
+		if err != nil {
+			return err
+		}
 		//fmt.Printf("Bike %v updated\n", bikeid)
+		act.Bike = fmt.Sprintf("Existing bike %v", e.Bike)
 	}
-	rt, ok := RBLR_Routes[e.Route]
-	if !ok {
-		rt = RBLR_Routes["A-NCW"]
-	}
+	rt, _ := find_rblr_route(sess.Routes, e.Route)
 	if e.EntrantStatus != Finisher {
-		rt, ok = RBLR_Lates[e.Route]
-		if !ok {
-			rt = RBLR_Lates["A-NCW"]
-		}
-
+		rt.RideName = rt.LateRideName
 	}
 
-	dupecheck := fmt.Sprintf("SELECT NameOnCertificate FROM rides WHERE riderid=%v AND DateRideStart='%v' AND IBA_Ride='%v'", riderid, rp.Ridedate, rt.RideName)
-	x := getStringFromDB(dupecheck, "")
+	dupecheck := "SELECT NameOnCertificate FROM rides WHERE riderid=? AND DateRideStart=? AND IBA_Ride=?"
+	x, err := getStringFromDB(sess.tx, dupecheck, "", riderid, rp.Ridedate, rt.RideName)
+	if err != nil {
+		return err
+	}
 	if x == ridername {
 		//fmt.Println("Ride is duplicated")
-		return
+		act.Ride = "Duplicate ride skipped"
+		return nil
 	}
 
-	uri := getIntegerFromDB("SELECT max(URI) FROM rides", 0) + 1
-	rideid := getIntegerFromDB("SELECT recid FROM ridenames WHERE IBA_Ride='"+rt.RideName+"'", 0)
+	uri, err := allocate_id(sess.tx, "rides")
+	if err != nil {
+		return err
+	}
+	rideid, err := getIntegerFromDB(sess.tx, "SELECT recid FROM ridenames WHERE IBA_Ride=?", 0, rt.RideName)
+	if err != nil {
+		return err
+	}
 	sqlx := "INSERT INTO rides (URI,riderid,NameOnCertificate,DateRideStart,DateRideFinish,IBA_Ride,IsPillion,EventName,KmsOdo,TotalMiles,bikeid,StartPoint,FinishPoint,MidPoints,DateRcvd,RideVerifier,DateVerified,DateCertSent,IBA_RideID,DatePayRcvd,DatePayReq,ShowRoH,StartOdo,FinishOdo,TimeStart,TimeFinish,RideHours,RideMins,VerifierNotes)"
 	sqlx += "VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 	//fmt.Println(sqlx)
-	stmt, err := DBH.Prepare(sqlx)
-	checkerr(err)
+	stmt, err := sess.tx.Prepare(sqlx)
+	if err != nil {
+		return err
+	}
 	//fmt.Println("All good")
 	defer stmt.Close()
 
 	showRoH := "Y"
-	IBAFinisher := e.EntrantStatus == Finisher && rt.Miles >= 1000
-	if !IBAFinisher {
+	if !rblr_iba_finisher(sess, e) {
 		showRoH = "N"
 	}
 
 	hrs, mins := calc_rblr_ridelength(e.StartTime, e.FinishTime)
 	_, err = stmt.Exec(uri, riderid, ridername, rp.Ridedate, rp.Ridedate, rt.RideName, pn, rp.EventDesc, km, rt.Miles, bikeid, rt.Start, rt.Finish, rt.Via, rp.Ridedate, "RBLR", rp.Ridedate, rp.Ridedate, rideid, rp.Ridedate, rp.Ridedate, showRoH, e.OdoStart, e.OdoFinish, e.StartTime, e.FinishTime, hrs, mins, e.Notes)
-	checkerr(err)
-	loadstats.NewRides++
-	switch e.Route {
-	case "A-NCW":
-		loadstats.Ncw++
-	case "B-NAC":
-		loadstats.Nac++
-	case "C-SCW":
-		loadstats.Scw++
-	case "D-SAC":
-		loadstats.Sac++
-	case "E-5CW":
-		loadstats.Cw5++
-	case "F-5AC":
-		loadstats.Ac5++
+	if err != nil {
+		return err
+	}
+	err = journal_insert(sess, "rides", uri)
+	if err != nil {
+		return err
+	}
+	sess.Stats.NewRides++
+	act.Ride = fmt.Sprintf("New %v ride", rt.RideName)
+	sess.Stats.Routes[e.Route]++
+	if e.EntrantStatus != Finisher {
+		sess.Stats.LateRides++
+	} else if rt.Miles < 1000 {
+		sess.Stats.ShortRides++
 	}
 
-}
-
-func safesql(x string) string {
-
-	return strings.ReplaceAll(strings.TrimSpace(x), "'", "''")
+	return nil
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRiderContactUpdates(t *testing.T) {
+
+	tests := []struct {
+		desc string
+		e    rally_Entrant
+		cols []string
+		vals []any
+	}{
+		{"nothing given", rally_Entrant{RiderName: "Bob Stammers", Bike: "Honda"}, []string{}, []any{}},
+		{"blanks", rally_Entrant{Email: " ", Phone: "", Postal_Address: " | "}, []string{}, []any{}},
+		{"some given", rally_Entrant{Email: "bob@example.com", Postcode: "SW1A 1AA"}, []string{"Postcode", "Email"}, []any{"SW1A 1AA", "bob@example.com"}},
+		{"all given", rally_Entrant{Postal_Address: "1 High St | Town", Postcode: "SW1A 1AA", Country: "UK", Email: "bob@example.com", Phone: "07700 900123"},
+			[]string{"Postal_Address", "Postcode", "Country", "Email", "Phone"}, []any{"1 High St\r\nTown", "SW1A 1AA", "UK", "bob@example.com", "07700 900123"}},
+	}
+	for _, tc := range tests {
+		cols, vals := rider_contact_updates(tc.e)
+		if !slices.Equal(cols, tc.cols) || !slices.Equal(vals, tc.vals) {
+			t.Errorf("%v: %q %q, want %q %q", tc.desc, cols, vals, tc.cols, tc.vals)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each run of an importer is recorded as a batch. Every row inserted or updated
+// by that run is journalled against the batch so that the whole load can be undone.
+
+const journalInsert = "I"
+const journalUpdate = "U"
+
+// The tables, and their keys, which may appear in the journal
+var journalKeys = map[string]string{
+	"rallies":      "RallyID",
+	"riders":       "riderid",
+	"bikes":        "bikeid",
+	"rides":        "URI",
+	"rallyresults": "recid",
+
+	"rally_dates":         "RallyID",
+	"rallyresult_classes": "recid",
+	"rblr_participation":  "recid",
+}
+
+// Rows inserted by one batch may since have been used by another without being touched,
+// as when a later year's results refer to a rally created by an earlier year. Undoing
+// the earlier batch keeps any such row.
+var journalDependents = map[string]string{
+	"rallies": "SELECT count(*) FROM rallyresults WHERE substr(RallyID,1,length(RallyID)-2)=?",
+}
+
+func start_import_batch(tx *sql.Tx, batchtype string, source string, data string, loadedby string) (int64, error) {
+
+	hash := sha256.Sum256([]byte(data))
+	sqlx := "INSERT INTO rupert_batches (BatchType,Source,FileHash,LoadedBy,LoadedAt) VALUES(?,?,?,?,?)"
+	res, err := tx.Exec(sqlx, batchtype, source, hex.EncodeToString(hash[:]), loadedby, time.Now().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// loaded_by describes who is running an import
+func loaded_by(r *http.Request) string {
+
+	if user := current_user(r); user.Name != "" {
+		return user.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// journal_insert records a newly inserted row
+func journal_insert(sess *import_Session, table string, key any) error {
+
+	if sess.Batch == 0 {
+		return nil
+	}
+	sqlx := "INSERT INTO rupert_journal (batchid,TableName,KeyName,KeyValue,Action,PriorValues) VALUES(?,?,?,?,?,'')"
+	_, err := sess.tx.Exec(sqlx, sess.Batch, table, journalKeys[table], key, journalInsert)
+	return err
+}
+
+// journal_update records the current values of cols in a row which is about to be updated
+func journal_update(sess *import_Session, table string, key any, cols []string) error {
+
+	if sess.Batch == 0 {
+		return nil
+	}
+	keycol := journalKeys[table]
+	sqlx := "SELECT " + strings.Join(cols, ",") + " FROM " + table + " WHERE " + keycol + "=?"
+	rows, err := sess.tx.Query(sqlx, key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return rows.Err()
+	}
+	vals := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	err = rows.Scan(ptrs...)
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	prior := make(map[string]any, len(cols))
+	for i, col := range cols {
+		if b, ok := vals[i].([]byte); ok {
+			prior[col] = string(b)
+		} else {
+			prior[col] = vals[i]
+		}
+	}
+	js, err := json.Marshal(prior)
+	if err != nil {
+		return err
+	}
+
+	sqlx = "INSERT INTO rupert_journal (batchid,TableName,KeyName,KeyValue,Action,PriorValues) VALUES(?,?,?,?,?,?)"
+	_, err = sess.tx.Exec(sqlx, sess.Batch, table, keycol, key, journalUpdate, string(js))
+	return err
+}
+
+type journal_Entry struct {
+	Table  string
+	Key    any
+	Action string
+	Prior  string
+}
+
+// undo_import_batch reverses every journalled change made by the batch, newest first
+func undo_import_batch(tx *sql.Tx, batch int64) error {
+
+	undone, err := getStringFromDB(tx, "SELECT UndoneAt FROM rupert_batches WHERE batchid=?", "?", batch)
+	if err != nil {
+		return err
+	}
+	if undone != "" {
+		return fmt.Errorf("batch %v does not exist or has already been undone", batch)
+	}
+
+	// Refuse if a later batch, still in force, has touched the same rows
+	sqlx := `SELECT count(*) FROM rupert_journal j JOIN rupert_batches b ON j.batchid=b.batchid
+		WHERE j.batchid>? AND b.UndoneAt='' AND (j.TableName,j.KeyValue) IN
+		(SELECT TableName,KeyValue FROM rupert_journal WHERE batchid=?)`
+	later, err := getIntegerFromDB(tx, sqlx, 0, batch, batch)
+	if err != nil {
+		return err
+	}
+	if later > 0 {
+		return fmt.Errorf("batch %v has been overtaken by later imports, undo those first", batch)
+	}
+
+	rows, err := tx.Query("SELECT TableName,KeyValue,Action,PriorValues FROM rupert_journal WHERE batchid=? ORDER BY recid DESC", batch)
+	if err != nil {
+		return err
+	}
+	entries := make([]journal_Entry, 0)
+	for rows.Next() {
+		var je journal_Entry
+		err = rows.Scan(&je.Table, &je.Key, &je.Action, &je.Prior)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, je)
+	}
+	rows.Close()
+
+	for _, je := range entries {
+		keycol, ok := journalKeys[je.Table]
+		if !ok {
+			return fmt.Errorf("journal refers to unexpected table %v", je.Table)
+		}
+		switch je.Action {
+		case journalInsert:
+			if sqlx, ok := journalDependents[je.Table]; ok {
+				n, err := getIntegerFromDB(tx, sqlx, 0, je.Key)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					continue
+				}
+			}
+			_, err = tx.Exec("DELETE FROM "+je.Table+" WHERE "+keycol+"=?", je.Key)
+			if err != nil {
+				return err
+			}
+		case journalUpdate:
+			dec := json.NewDecoder(strings.NewReader(je.Prior))
+			dec.UseNumber()
+			var prior map[string]any
+			err = dec.Decode(&prior)
+			if err != nil {
+				return err
+			}
+			cols := make([]string, 0, len(prior))
+			vals := make([]any, 0, len(prior)+1)
+			for col, val := range prior {
+				if n, ok := val.(json.Number); ok {
+					if i, err := n.Int64(); err == nil {
+						val = i
+					} else {
+						val, _ = n.Float64()
+					}
+				}
+				cols = append(cols, col+"=?")
+				vals = append(vals, val)
+			}
+			vals = append(vals, je.Key)
+			_, err = tx.Exec("UPDATE "+je.Table+" SET "+strings.Join(cols, ",")+" WHERE "+keycol+"=?", vals...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE rupert_batches SET UndoneAt=? WHERE batchid=?", time.Now().Format("2006-01-02 15:04:05"), batch)
+	return err
+}
+
+// show_imports lists the import batches and handles requests to undo them
+func show_imports(w http.ResponseWriter, r *http.Request) {
+
+	if !allow_methods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	type batch_Row struct {
+		Batch    int64
+		Type     string
+		Source   string
+		LoadedBy string
+		LoadedAt string
+		UndoneAt string
+		Rows     int64
+	}
+	var data struct {
+		CSRF    string
+		Message string
+		Error   string
+		Batches []batch_Row
+	}
+	data.CSRF = csrf_token(r)
+
+	if r.Method == http.MethodPost && r.FormValue("undo") != "" {
+		batch, _ := strconv.ParseInt(r.FormValue("undo"), 10, 64)
+		tx, err := DBH.Begin()
+		if err == nil {
+			err = undo_import_batch(tx, batch)
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = fmt.Sprintf("Import %v has been undone", batch)
+		}
+	}
+
+	sqlx := `SELECT b.batchid,b.BatchType,b.Source,b.LoadedBy,b.LoadedAt,b.UndoneAt,
+		(SELECT count(*) FROM rupert_journal j WHERE j.batchid=b.batchid)
+		FROM rupert_batches b ORDER BY b.batchid DESC`
+	rows, err := DBH.Query(sqlx)
+	if err != nil {
+		data.Error = err.Error()
+		render(w, "imports", data)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b batch_Row
+		err = rows.Scan(&b.Batch, &b.Type, &b.Source, &b.LoadedBy, &b.LoadedAt, &b.UndoneAt, &b.Rows)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		data.Batches = append(data.Batches, b)
+	}
+	render(w, "imports", data)
+
+}
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
 
 	_ "embed"
@@ -20,6 +21,13 @@ var DBNAME *string = flag.String("db", "ibaukrd.db", "database file")
 // HTTPPort is the web port to serve
 var HTTPPort *string = flag.String("port", "1080", "Web port")
 
+// AddUser names a user to be created, or have their password changed, instead of serving
+var AddUser *string = flag.String("adduser", "", "create or update a user, reading the password from stdin, then exit")
+
+// UserRole and UserRallies set the permissions of the user named by -adduser
+var UserRole *string = flag.String("role", "", "role for -adduser: admin, rally or rblr; required for a new user, otherwise their role is kept")
+var UserRallies *string = flag.String("rallies", "", "comma separated rally codes a rally role may load")
+
 // DBH provides access to the database
 var DBH *sql.DB
 
@@ -29,43 +37,46 @@ func checkerr(err error) {
 	}
 }
 
-func getIntegerFromDB(sqlx string, defval int64) int64 {
-
-	rows, err := DBH.Query(sqlx)
-	checkerr(err)
-	defer rows.Close()
-	if rows.Next() {
-		var val int64
-		rows.Scan(&val)
-		return val
-	}
-	return defval
+// dbrunner is satisfied by both *sql.DB and *sql.Tx
+type dbrunner interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
 }
 
-func getStringFromDB(sqlx string, defval string) string {
+func getIntegerFromDB(db dbrunner, sqlx string, defval int64, args ...any) (int64, error) {
 
-	rows, err := DBH.Query(sqlx)
-	checkerr(err)
+	rows, err := db.Query(sqlx, args...)
+	if err != nil {
+		return defval, err
+	}
 	defer rows.Close()
 	if rows.Next() {
-		var val string
-		rows.Scan(&val)
-		return val
+		var val sql.NullInt64
+		err = rows.Scan(&val)
+		if err != nil || !val.Valid {
+			return defval, err
+		}
+		return val.Int64, nil
 	}
-	return defval
+	return defval, rows.Err()
 }
 
-func intval(x string) int {
+func getStringFromDB(db dbrunner, sqlx string, defval string, args ...any) (string, error) {
 
-	res := 0
-	for ix := 0; ix < len(x); ix++ {
-		c := x[ix]
-		if c < '0' || c > '9' {
-			break
+	rows, err := db.Query(sqlx, args...)
+	if err != nil {
+		return defval, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var val sql.NullString
+		err = rows.Scan(&val)
+		if err != nil || !val.Valid {
+			return defval, err
 		}
-		res = res*10 + (int(c) - int('0'))
+		return val.String, nil
 	}
-	return res
+	return defval, rows.Err()
 }
 
 func main() {
@@ -75,16 +86,38 @@ func main() {
 
 	dbx, _ := filepath.Abs(*DBNAME)
 	fmt.Printf("Using %v\n", dbx)
-	fmt.Printf("Listening on port %v\n\n", *HTTPPort)
 
+	// Transactions take the write lock as soon as they start so that concurrent
+	// imports, or the PHP front end, are serialized rather than interleaved.
 	var err error
-	DBH, err = sql.Open("sqlite3", dbx)
+	DBH, err = sql.Open("sqlite3", dbx+"?_txlock=immediate&_busy_timeout=10000")
 	checkerr(err)
+	ensure_rupert_tables()
+
+	if *AddUser != "" {
+		checkerr(add_user_from_console(*AddUser, *UserRole, parse_rally_codes(*UserRallies)))
+		return
+	}
+	if flag.NArg() > 0 {
+		os.Exit(run_subcommand(flag.Args()))
+	}
+	if n, _ := getIntegerFromDB(DBH, "SELECT count(*) FROM rupert_users", 0); n < 1 {
+		fmt.Println("No users are set up, create one using -adduser")
+	}
+	checkerr(purge_uploads())
+	go purge_uploads_hourly()
+	fmt.Printf("Listening on port %v\n\n", *HTTPPort)
 
 	http.HandleFunc("/", show_root)
 	http.HandleFunc("/help", show_help)
-	http.HandleFunc("/rally", import_rally)
-	http.HandleFunc("/rblr", import_rblr)
+	http.HandleFunc("/login", show_login)
+	http.HandleFunc("/logout", show_logout)
+	http.HandleFunc("/rally", limit_upload(require_role(import_rally, roleAdmin, roleRally)))
+	http.HandleFunc("/rblr", limit_upload(require_role(import_rblr, roleAdmin, roleRBLR)))
+	http.HandleFunc("/event", limit_upload(require_role(import_event, roleAdmin)))
+	http.HandleFunc("/imports", require_role(show_imports, roleAdmin))
+	http.HandleFunc("/routes", require_role(show_routes, roleAdmin))
+	http.HandleFunc("/participation", require_role(show_participation, roleAdmin, roleRBLR))
 	err = http.ListenAndServe(":"+*HTTPPort, nil)
 	checkerr(err)
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// match_Person describes a rider or pillion being imported, as far as matching
+// against existing riders records is concerned.
+type match_Person struct {
+	Key      string
+	Name     string
+	IBA      string
+	Email    string
+	Phone    string
+	Postcode string
+}
+
+// rider_Candidate is an existing riders record which might be the person being imported
+type rider_Candidate struct {
+	Riderid     int64
+	Name        string
+	IBA         string
+	Email       string
+	Postcode    string
+	Score       int
+	Evidence    string
+	IBAMatch    bool
+	IBAConflict bool
+}
+
+const matchFieldPrefix = "match_"
+
+// match_key identifies one person within an import file
+func match_key(ix int, isPillion bool) string {
+
+	if isPillion {
+		return fmt.Sprintf("P%v", ix)
+	}
+	return fmt.Sprintf("R%v", ix)
+}
+
+// parse_resolutions extracts the operator's choices from the reconciliation screen,
+// keyed by match_key. The value is the riderid to use or zero to create a new rider.
+func parse_resolutions(r *http.Request) map[string]int64 {
+
+	res := make(map[string]int64)
+	r.FormValue(matchFieldPrefix) // Make sure the form is parsed
+	for k, v := range r.Form {
+		if !strings.HasPrefix(k, matchFieldPrefix) || len(v) < 1 {
+			continue
+		}
+		id, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			id = 0
+		}
+		res[strings.TrimPrefix(k, matchFieldPrefix)] = id
+	}
+	return res
+}
+
+// find_rider_candidates returns existing riders who might be p, best first
+func find_rider_candidates(sess *import_Session, p match_Person) []rider_Candidate {
+
+	res := make([]rider_Candidate, 0)
+
+	tokens := normalize_name(p.Name)
+	surname := ""
+	if len(tokens) > 0 {
+		surname = tokens[len(tokens)-1]
+	}
+	iba := normalize_iba(p.IBA)
+	email := strings.ToLower(strings.TrimSpace(p.Email))
+
+	for _, ir := range sess.Riders {
+		// Only score those with some plausible connection
+		if !(iba != "" && iba == ir.IBA) && !(email != "" && email == ir.Email) && edit_distance(surname, ir.Surname) > 2 {
+			continue
+		}
+		c := score_rider(p, tokens, ir)
+		// A good name match is worth showing even if the IBA numbers disagree
+		if c.Score >= matchMinScore || c.IBAMatch || (c.IBAConflict && c.Score-matchIBAConflict >= matchAcceptScore) {
+			res = append(res, c)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Score > res[j].Score })
+	return res
+}
+
+// best_candidate is the rider p should be matched with in the absence of any choice by
+// the operator, if any. A matching IBA number is preferred, otherwise the best scoring
+// candidate if it's good enough.
+func best_candidate(cands []rider_Candidate) (rider_Candidate, bool) {
+
+	for _, c := range cands {
+		if c.IBAMatch {
+			return c, true
+		}
+	}
+	if len(cands) > 0 && cands[0].Score >= matchAcceptScore {
+		return cands[0], true
+	}
+	return rider_Candidate{}, false
+}
+
+// ambiguity explains why the operator needs to choose a rider for p, or is
+// empty if the match, or the need for a new rider, is clear cut.
+func ambiguity(p match_Person, cands []rider_Candidate) string {
+
+	if len(cands) == 0 {
+		return ""
+	}
+	best, ok := best_candidate(cands)
+	if ok && best.IBAMatch && best.Score < matchAcceptScore {
+		return fmt.Sprintf("IBA number %v belongs to %v", p.IBA, best.Name)
+	}
+	if !ok {
+		if cands[0].IBAConflict {
+			return fmt.Sprintf("Name matches rider %v but IBA number %v differs", cands[0].Riderid, cands[0].IBA)
+		}
+		return fmt.Sprintf("Similar names already on file (best %v%%)", cands[0].Score)
+	}
+	close := 0
+	for _, c := range cands {
+		if c.Score >= matchAcceptScore && c.Score > best.Score-matchMargin {
+			close++
+		}
+	}
+	if close > 1 {
+		return fmt.Sprintf("%v riders are similar to %v", close, p.Name)
+	}
+	return ""
+}
+
+// resolve_rider decides which existing rider, if any, p refers to. A zero riderid
+// means a new riders record is needed. The operator may only choose one of the
+// candidates offered on the reconciliation screen.
+func resolve_rider(sess *import_Session, p match_Person) (int64, string, error) {
+
+	cands := find_rider_candidates(sess, p)
+	if id, ok := sess.Resolutions[p.Key]; ok {
+		if id == 0 {
+			return 0, "", nil
+		}
+		for _, c := range cands {
+			if c.Riderid == id {
+				return id, fmt.Sprintf("Chosen by operator (rider %v)", id), nil
+			}
+		}
+		return 0, "", fmt.Errorf("rider %v was not one of those offered for %v", id, p.Name)
+	}
+
+	best, ok := best_candidate(cands)
+	if !ok {
+		return 0, "", nil
+	}
+	how := "Matched by name"
+	if best.IBAMatch {
+		how = "Matched by IBA number"
+	}
+	return best.Riderid, fmt.Sprintf("%v (rider %v, %v%% on %v)", how, best.Riderid, best.Score, best.Evidence), nil
+}
+
+// rider_Ambiguity is a person the operator must decide how to record
+type rider_Ambiguity struct {
+	Person match_Person
+	Reason string
+	Cands  []rider_Candidate
+	Chosen int64  // Initial choice, zero for a new rider
+	Field  string // Name of the form field holding the choice
+}
+
+// find_ambiguities lists the people whose match isn't clear cut, by name
+func find_ambiguities(sess *import_Session, people []match_Person) []rider_Ambiguity {
+
+	res := make([]rider_Ambiguity, 0)
+	for _, p := range people {
+		cands := find_rider_candidates(sess, p)
+		why := ambiguity(p, cands)
+		if why == "" {
+			continue
+		}
+		chosen, _ := best_candidate(cands)
+		if id, ok := sess.Resolutions[p.Key]; ok {
+			chosen.Riderid = id
+		}
+		res = append(res, rider_Ambiguity{p, why, cands, chosen.Riderid, matchFieldPrefix + p.Key})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Person.Name < res[j].Person.Name })
+	return res
+}
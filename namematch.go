@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rider names arrive in all sorts of shapes: "Bob Stammers" vs "Robert Stammers", accents,
+// double spaces, capitals and "O'Neill" / "O Neill" / "ONeill". Names are reduced to a
+// normal form before being compared by edit distance and any supporting evidence from
+// the import, such as email or postcode, adds to the confidence of a match.
+
+// Scores are percentages
+const (
+	matchNameWeight  = 60  // for an exact match of normalized names
+	matchIBAWeight   = 40  // IBA numbers agree
+	matchIBAConflict = -30 // both have IBA numbers which disagree
+	matchEmailWeight = 20
+	matchPhoneWeight = 10
+	matchPostWeight  = 10
+	matchMinScore    = 40 // candidates scoring less are ignored
+	matchAcceptScore = 60 // the best candidate is accepted automatically at or above this
+	matchMargin      = 10 // unless another candidate is this close
+)
+
+var diacritics = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "æ", "ae",
+	"ç", "c", "č", "c", "ć", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ę", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ł", "l", "ñ", "n", "ń", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "œ", "oe",
+	"š", "s", "ś", "s", "ß", "ss",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ý", "y", "ÿ", "y", "ž", "z", "ż", "z", "ź", "z",
+	"'", "", "’", "", "‘", "", "`", "", ".", "",
+	"-", " ", ",", " ",
+)
+
+// Name prefixes which are sometimes written as separate words
+var nameprefixes = map[string]bool{"o": true, "mc": true, "mac": true}
+
+// Common short forms of first names
+var nicknames = map[string]string{
+	"al": "alan", "alf": "alfred", "andy": "andrew", "ben": "benjamin", "bert": "albert",
+	"bill": "william", "billy": "william", "bob": "robert", "bobby": "robert",
+	"cathy": "catherine", "kate": "catherine", "katie": "catherine", "chris": "christopher",
+	"dan": "daniel", "danny": "daniel", "dave": "david", "davy": "david",
+	"dick": "richard", "rich": "richard", "rick": "richard", "ricky": "richard",
+	"don": "donald", "ed": "edward", "eddie": "edward", "ted": "edward",
+	"fred": "frederick", "geoff": "geoffrey", "greg": "gregory",
+	"jim": "james", "jimmy": "james", "jamie": "james", "jen": "jennifer", "jenny": "jennifer",
+	"joe": "joseph", "jon": "john", "johnny": "john", "jack": "john",
+	"ken": "kenneth", "kenny": "kenneth", "liz": "elizabeth", "beth": "elizabeth",
+	"matt": "matthew", "mick": "michael", "mike": "michael", "mickey": "michael",
+	"nick": "nicholas", "pat": "patrick", "pete": "peter", "phil": "philip",
+	"rob": "robert", "robbie": "robert", "ron": "ronald", "ronnie": "ronald",
+	"sam": "samuel", "steve": "stephen", "stevie": "stephen", "steven": "stephen",
+	"sue": "susan", "suzy": "susan", "tim": "timothy", "tom": "thomas", "tommy": "thomas",
+	"tony": "anthony", "will": "william", "willie": "william",
+}
+
+// normalize_name returns the tokens of a name reduced to a standard form
+func normalize_name(name string) []string {
+
+	x := diacritics.Replace(strings.ToLower(name))
+	res := make([]string, 0)
+	pfx := ""
+	for _, t := range strings.Fields(x) {
+		if nameprefixes[t] && len(res) > 0 {
+			pfx += t
+			continue
+		}
+		res = append(res, pfx+t)
+		pfx = ""
+	}
+	if pfx != "" {
+		res = append(res, pfx)
+	}
+	if len(res) > 0 {
+		if n, ok := nicknames[res[0]]; ok {
+			res[0] = n
+		}
+	}
+	return res
+}
+
+func normalize_phone(x string) string {
+
+	res := make([]byte, 0, len(x))
+	for i := 0; i < len(x); i++ {
+		if x[i] >= '0' && x[i] <= '9' {
+			res = append(res, x[i])
+		}
+	}
+	s := string(res)
+	if strings.HasPrefix(s, "44") {
+		s = "0" + s[2:]
+	}
+	return s
+}
+
+func normalize_postcode(x string) string {
+
+	return strings.ToUpper(strings.Join(strings.Fields(x), ""))
+}
+
+func normalize_iba(x string) string {
+
+	x = strings.TrimSpace(x)
+	if x == "0" {
+		return ""
+	}
+	return x
+}
+
+// edit_distance is the Levenshtein distance between a and b
+func edit_distance(a string, b string) int {
+
+	ra := []rune(a)
+	rb := []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func similarity(a string, b string) float64 {
+
+	n := max(len([]rune(a)), len([]rune(b)))
+	if n == 0 {
+		return 0
+	}
+	return 1 - float64(edit_distance(a, b))/float64(n)
+}
+
+// name_similarity compares two normalized names, ignoring middle names if that helps
+func name_similarity(a []string, b []string) float64 {
+
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	sim := similarity(strings.Join(a, " "), strings.Join(b, " "))
+	if len(a) > 2 || len(b) > 2 {
+		fl := similarity(a[0]+" "+a[len(a)-1], b[0]+" "+b[len(b)-1])
+		sim = max(sim, fl)
+	}
+	return sim
+}
+
+// indexed_Rider is an existing riders record prepared for matching
+type indexed_Rider struct {
+	rider_Candidate
+	Tokens   []string
+	Surname  string
+	IBA      string
+	Email    string
+	Phone    string
+	Postcode string
+}
+
+func index_rider(c rider_Candidate, phone string) indexed_Rider {
+
+	ir := indexed_Rider{rider_Candidate: c, Tokens: normalize_name(c.Name)}
+	ir.IBA = normalize_iba(c.IBA)
+	ir.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	ir.Phone = normalize_phone(phone)
+	ir.Postcode = normalize_postcode(c.Postcode)
+	if len(ir.Tokens) > 0 {
+		ir.Surname = ir.Tokens[len(ir.Tokens)-1]
+	}
+	return ir
+}
+
+// load_rider_index reads all riders ready for matching
+func load_rider_index(db dbrunner) ([]indexed_Rider, error) {
+
+	res := make([]indexed_Rider, 0)
+	sqlx := `SELECT riderid,ifnull(Rider_Name,''),ifnull(IBA_Number,''),ifnull(Email,''),ifnull(Postcode,''),ifnull(Phone,'') FROM riders ORDER BY riderid`
+	rows, err := db.Query(sqlx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rc rider_Candidate
+		var phone string
+		err = rows.Scan(&rc.Riderid, &rc.Name, &rc.IBA, &rc.Email, &rc.Postcode, &phone)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, index_rider(rc, phone))
+	}
+	return res, rows.Err()
+}
+
+// add_to_rider_index makes a newly created rider available to later matches
+func add_to_rider_index(sess *import_Session, riderid int64, p match_Person) {
+
+	rc := rider_Candidate{Riderid: riderid, Name: p.Name, IBA: p.IBA, Email: p.Email, Postcode: p.Postcode}
+	sess.Riders = append(sess.Riders, index_rider(rc, p.Phone))
+}
+
+// score_rider rates how likely it is that ir is the person p
+func score_rider(p match_Person, tokens []string, ir indexed_Rider) rider_Candidate {
+
+	c := ir.rider_Candidate
+	why := make([]string, 0)
+
+	sim := name_similarity(tokens, ir.Tokens)
+	score := int(sim*matchNameWeight + 0.5)
+	if sim == 1 {
+		why = append(why, "name")
+	} else {
+		why = append(why, fmt.Sprintf("name %v%%", int(sim*100)))
+	}
+
+	iba := normalize_iba(p.IBA)
+	if iba != "" && ir.IBA != "" {
+		if iba == ir.IBA {
+			score += matchIBAWeight
+			c.IBAMatch = true
+			why = append(why, "IBA number")
+		} else {
+			score += matchIBAConflict
+			c.IBAConflict = true
+			why = append(why, "different IBA number")
+		}
+	}
+	if email := strings.ToLower(strings.TrimSpace(p.Email)); email != "" && email == ir.Email {
+		score += matchEmailWeight
+		why = append(why, "email")
+	}
+	if phone := normalize_phone(p.Phone); len(phone) > 6 && phone == ir.Phone {
+		score += matchPhoneWeight
+		why = append(why, "phone")
+	}
+	if pc := normalize_postcode(p.Postcode); pc != "" && pc == ir.Postcode {
+		score += matchPostWeight
+		why = append(why, "postcode")
+	}
+	c.Score = max(0, min(100, score))
+	c.Evidence = strings.Join(why, ", ")
+	return c
+}
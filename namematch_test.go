@@ -0,0 +1,120 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Robert Stammers", []string{"robert", "stammers"}},
+		{"Bob Stammers", []string{"robert", "stammers"}},
+		{"bob  STAMMERS ", []string{"robert", "stammers"}},
+		{"Sean O'Neill", []string{"sean", "oneill"}},
+		{"Sean O Neill", []string{"sean", "oneill"}},
+		{"Sean ONeill", []string{"sean", "oneill"}},
+		{"Sean O’Neill", []string{"sean", "oneill"}},
+		{"Angus Mac Donald", []string{"angus", "macdonald"}},
+		{"Zoë Brontë", []string{"zoe", "bronte"}},
+		{"José  Núñez", []string{"jose", "nunez"}},
+		{"Anne-Marie Smith", []string{"anne", "marie", "smith"}},
+		{"O Connor", []string{"o", "connor"}}, // A leading O is a name, not a prefix
+		{"", []string{}},
+	}
+	for _, tc := range tests {
+		if got := normalize_name(tc.name); !slices.Equal(got, tc.want) {
+			t.Errorf("normalize_name(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"stammers", "stammers", 0},
+		{"stammers", "stamers", 1},
+		{"kitten", "sitting", 3},
+		{"smith", "smyth", 1},
+		{"zoë", "zoe", 1}, // Runes, not bytes
+	}
+	for _, tc := range tests {
+		if got := edit_distance(tc.a, tc.b); got != tc.want {
+			t.Errorf("edit_distance(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestScoreRider(t *testing.T) {
+
+	onfile := index_rider(rider_Candidate{Riderid: 1, Name: "Robert Stammers", IBA: "123", Email: "bob@example.com", Postcode: "SW1A 1AA"}, "07700 900123")
+
+	tests := []struct {
+		desc     string
+		p        match_Person
+		score    int
+		iba      bool
+		conflict bool
+		accept   bool
+	}{
+		{"exact name", match_Person{Name: "Robert Stammers"}, 60, false, false, true},
+		{"nickname", match_Person{Name: "Bob Stammers"}, 60, false, false, true},
+		{"double spaces and capitals", match_Person{Name: "ROBERT  STAMMERS"}, 60, false, false, true},
+		{"IBA match", match_Person{Name: "Bob Stammers", IBA: "123"}, 100, true, false, true},
+		{"IBA match, other name", match_Person{Name: "Fred Bloggs", IBA: "123"}, 55, true, false, true},
+		{"IBA conflict", match_Person{Name: "Bob Stammers", IBA: "456"}, 30, false, true, false},
+		{"zero IBA is no IBA", match_Person{Name: "Bob Stammers", IBA: "0"}, 60, false, false, true},
+		{"email", match_Person{Name: "Bob Stammers", Email: " BOB@example.com"}, 80, false, false, true},
+		{"phone and postcode", match_Person{Name: "Bob Stammers", Phone: "+44 7700 900123", Postcode: "sw1a1aa"}, 80, false, false, true},
+		{"misspelt", match_Person{Name: "Robert Stamers"}, 56, false, false, false},
+	}
+	for _, tc := range tests {
+		c := score_rider(tc.p, normalize_name(tc.p.Name), onfile)
+		if c.Score != tc.score || c.IBAMatch != tc.iba || c.IBAConflict != tc.conflict {
+			t.Errorf("%v: score %v, IBA match %v, conflict %v; want %v, %v, %v (%v)", tc.desc, c.Score, c.IBAMatch, c.IBAConflict, tc.score, tc.iba, tc.conflict, c.Evidence)
+		}
+		if _, ok := best_candidate([]rider_Candidate{c}); ok != tc.accept {
+			t.Errorf("%v: accepted %v, want %v", tc.desc, ok, tc.accept)
+		}
+	}
+}
+
+func TestAmbiguity(t *testing.T) {
+
+	robert := index_rider(rider_Candidate{Riderid: 1, Name: "Robert Stammers", IBA: "123"}, "")
+	rob := index_rider(rider_Candidate{Riderid: 2, Name: "Rob Stammers", IBA: ""}, "")
+
+	tests := []struct {
+		desc      string
+		riders    []indexed_Rider
+		p         match_Person
+		ambiguous bool
+		riderid   int64
+	}{
+		{"IBA number settles it", []indexed_Rider{robert, rob}, match_Person{Name: "Bob Stammers", IBA: "123"}, false, 1},
+		{"two riders of the same name", []indexed_Rider{robert, rob}, match_Person{Name: "Bob Stammers"}, true, 1},
+		{"IBA conflict", []indexed_Rider{robert}, match_Person{Name: "Robert Stammers", IBA: "999"}, true, 0},
+		{"IBA conflict passes over to a rider without a number", []indexed_Rider{robert, rob}, match_Person{Name: "Robert Stammers", IBA: "999"}, false, 2},
+		{"nobody like them", []indexed_Rider{robert, rob}, match_Person{Name: "Fred Bloggs"}, false, 0},
+	}
+	for _, tc := range tests {
+		sess := &import_Session{Riders: tc.riders}
+		cands := find_rider_candidates(sess, tc.p)
+		if why := ambiguity(tc.p, cands); (why != "") != tc.ambiguous {
+			t.Errorf("%v: ambiguity %q", tc.desc, why)
+		}
+		best, _ := best_candidate(cands)
+		if best.Riderid != tc.riderid {
+			t.Errorf("%v: best rider %v, want %v", tc.desc, best.Riderid, tc.riderid)
+		}
+	}
+}
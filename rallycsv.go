@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ScoreMaster exports vary between versions so the columns of a finishers file are
+// identified by their headings rather than their positions. Headings are compared
+// ignoring case, spaces and punctuation.
+
+type rally_Column struct {
+	Field    string   // Name of the rally_Entrant field
+	Headings []string // Acceptable headings, normalized
+	Required bool
+}
+
+var rallyColumns = []rally_Column{
+	{"RiderName", []string{"ridername", "rider", "name"}, true},
+	{"PillionName", []string{"pillionname", "pillion"}, false},
+	{"Bike", []string{"bike", "motorcycle"}, true},
+	{"Placing", []string{"placing", "finishposition", "position", "place", "rank"}, true},
+	{"Miles", []string{"miles", "correctedmiles", "rallymiles", "distance"}, true},
+	{"Points", []string{"points", "totalpoints", "rallypoints", "score"}, true},
+	{"RiderIBA", []string{"rideriba", "iba", "ibanumber", "rideribanumber"}, false},
+	{"PillionIBA", []string{"pillioniba", "pillionibanumber"}, false},
+	{"BikeReg", []string{"bikereg", "registration", "reg"}, false},
+	{"Class", []string{"class"}, false},
+	{"Phone", []string{"phone", "riderphone", "mobile"}, false},
+	{"Email", []string{"email", "rideremail"}, false},
+	{"Postcode", []string{"postcode", "zip", "zipcode"}, false},
+	{"Country", []string{"country"}, false},
+	{"Postal_Address", []string{"postaladdress", "address"}, false},
+	{"RiderRBL", []string{"riderrbl", "rbl"}, false},
+	{"NoviceRider", []string{"novicerider", "novice"}, false},
+	{"PillionRBL", []string{"pillionrbl"}, false},
+	{"NovicePillion", []string{"novicepillion"}, false},
+	{"KmsOdo", []string{"kmsodo", "odokms"}, false},
+	{"ClassName", []string{"classname"}, false},
+	{"Team", []string{"team", "teamname"}, false},
+}
+
+func normalize_heading(x string) string {
+
+	res := make([]rune, 0, len(x))
+	for _, c := range strings.ToLower(x) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			res = append(res, c)
+		}
+	}
+	return string(res)
+}
+
+// odo_in_kms interprets the KmsOdo column, which may be a flag or the units
+func odo_in_kms(x string) bool {
+
+	switch strings.ToLower(strings.TrimSpace(x)) {
+	case "y", "yes", "1", "true", "k", "km", "kms":
+		return true
+	}
+	return false
+}
+
+// map_rally_columns works out which column holds each rally_Entrant field. Columns
+// with headings we don't recognise are ignored.
+func map_rally_columns(hdr []string) (map[string]int, []string) {
+
+	cols := make(map[string]int)
+	problems := make([]string, 0)
+
+	pos := make(map[string]int)
+	for ix, h := range hdr {
+		n := normalize_heading(h)
+		if _, ok := pos[n]; !ok {
+			pos[n] = ix
+		}
+	}
+	for _, rc := range rallyColumns {
+		for _, h := range rc.Headings {
+			if ix, ok := pos[h]; ok {
+				cols[rc.Field] = ix
+				break
+			}
+		}
+		if _, ok := cols[rc.Field]; !ok && rc.Required {
+			problems = append(problems, fmt.Sprintf("Required column %v is missing", rc.Field))
+		}
+	}
+	return cols, problems
+}
+
+// parse_rally_records turns rows of a finishers file, headings first, into entrants.
+// Any problems are reported by row rather than crashing the import.
+func parse_rally_records(recs [][]string) ([]rally_Entrant, []string) {
+
+	res := make([]rally_Entrant, 0, len(recs))
+	if len(recs) < 1 {
+		return res, []string{"The file is empty"}
+	}
+	cols, problems := map_rally_columns(recs[0])
+	if len(problems) > 0 {
+		return res, problems
+	}
+
+	for rowix, ln := range recs[1:] {
+		if strings.TrimSpace(strings.Join(ln, "")) == "" {
+			continue
+		}
+		row := rowix + 2 // Numbered from 1 including the headings
+		var re rally_Entrant
+		rv := reflect.ValueOf(&re).Elem()
+		for _, rc := range rallyColumns {
+			ix, ok := cols[rc.Field]
+			if !ok || ix >= len(ln) {
+				continue
+			}
+			val := strings.TrimSpace(ln[ix])
+			if !set_column_value(rv, rc.Field, val) {
+				problems = append(problems, fmt.Sprintf("Row %v (%v): %v '%v' is not a number", row, re.RiderName, rc.Field, val))
+			}
+		}
+		if re.RiderName == "" {
+			problems = append(problems, fmt.Sprintf("Row %v: no rider name", row))
+			continue
+		}
+		res = append(res, re)
+	}
+	return res, problems
+}
+
+// set_column_value stores the text of a column in the named field of the struct rv,
+// converting it if the field is a number. It's false if the text isn't a number.
+func set_column_value(rv reflect.Value, field string, val string) bool {
+
+	fld := rv.FieldByName(field)
+	if fld.Kind() != reflect.Int {
+		fld.SetString(val)
+		return true
+	}
+	if val == "" {
+		return true
+	}
+	n, err := strconv.Atoi(strings.ReplaceAll(val, ",", ""))
+	if err != nil {
+		return false
+	}
+	fld.SetInt(int64(n))
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Alys labels its exports with a file type and the time they were taken. The time is
+// checked against the ride and the results it contains so that an export taken before
+// the ride, or before all the finish times were entered, is noticed.
+
+// alysFiletype is the file type expected of an export. It hasn't been confirmed against
+// Alys itself so any other file type is only a warning.
+const alysFiletype = "alys"
+
+// Exports taken long after the ride suggest the wrong Saturday has been given
+const maxExportDelay = 90 * 24 * time.Hour
+
+var alysTimeFormats = []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parse_rblr reads the JSON file output by Alys
+func parse_rblr(jdata string) (RBLR_Dataset, error) {
+
+	var rblr RBLR_Dataset
+	if jdata == "" {
+		return rblr, nil
+	}
+	err := json.Unmarshal([]byte(jdata), &rblr)
+	if err != nil {
+		return rblr, json_error(jdata, err)
+	}
+	return rblr, nil
+}
+
+// json_error adds the line and column to a decoding error
+func json_error(jdata string, err error) error {
+
+	var offset int64
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &se):
+		offset = se.Offset
+	case errors.As(err, &te):
+		offset = te.Offset
+		err = fmt.Errorf("%v should be %v, not %v", te.Field, te.Type, te.Value)
+	default:
+		return err
+	}
+	offset = min(offset, int64(len(jdata)))
+	before := []byte(jdata[:offset])
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("The JSON is invalid at line %v column %v: %v", line, col, err)
+}
+
+// parse_alys_time reads a timestamp in any of the forms Alys has used
+func parse_alys_time(x string) (time.Time, bool) {
+
+	for _, f := range alysTimeFormats {
+		if t, err := time.ParseInLocation(f, x, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// check_rblr_dataset compares the time the results were exported with the date of
+// the ride and the finish times they contain. An export taken before the ride is
+// refused, anything else merely doubtful is returned as a warning. A database read
+// straight from Alys wasn't exported so there's nothing to check.
+func check_rblr_dataset(ds RBLR_Dataset, ridedate string) ([]string, error) {
+
+	warnings := make([]string, 0)
+	if ds.Database {
+		return warnings, nil
+	}
+	if ds.Filetype != alysFiletype {
+		warnings = append(warnings, fmt.Sprintf("The file's Filetype is '%v' rather than '%v', please check it is an Alys export", ds.Filetype, alysFiletype))
+	}
+	asat, ok := parse_alys_time(ds.Asat)
+	if !ok {
+		return append(warnings, fmt.Sprintf("The file doesn't say when it was exported (Asat '%v')", ds.Asat)), nil
+	}
+	saturday, ok := parse_alys_time(ridedate)
+	if !ok {
+		return warnings, fmt.Errorf("'%v' is not a valid date", ridedate)
+	}
+	if asat.Before(saturday) {
+		return warnings, fmt.Errorf("The file was exported on %v, before the ride on %v", ds.Asat, ridedate)
+	}
+	if asat.Sub(saturday) > maxExportDelay {
+		warnings = append(warnings, fmt.Sprintf("The file was exported on %v, long after the ride on %v. Please check the date.", ds.Asat, ridedate))
+	}
+
+	var last time.Time
+	lastfinish := ""
+	for _, e := range ds.Entrants {
+		if t, ok := parse_alys_time(e.FinishTime); ok && t.After(last) {
+			last = t
+			lastfinish = e.FinishTime
+		}
+	}
+	if lastfinish != "" && asat.Before(last) {
+		warnings = append(warnings, fmt.Sprintf("The file was exported on %v, before the last finish time of %v. Later results may be missing.", ds.Asat, lastfinish))
+	}
+	return warnings, nil
+}
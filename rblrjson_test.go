@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRBLRDataset(t *testing.T) {
+
+	tests := []struct {
+		desc     string
+		jdata    string
+		warnings []string
+		fails    bool
+	}{
+		{"good export", `{"Filetype":"alys","Asat":"2025-06-15T10:00","Entrants":[]}`, nil, false},
+		{"other file type", `{"Filetype":"alys-export","Asat":"2025-06-15T10:00","Entrants":[]}`, []string{"Filetype is 'alys-export'"}, false},
+		{"no export time", `{"Filetype":"alys","Entrants":[]}`, []string{"doesn't say when"}, false},
+		{"exported long after", `{"Filetype":"alys","Asat":"2025-12-01T10:00","Entrants":[]}`, []string{"long after"}, false},
+		{"exported before the ride", `{"Filetype":"alys","Asat":"2025-06-13T10:00","Entrants":[]}`, nil, true},
+	}
+	for _, tc := range tests {
+		ds, err := parse_rblr(tc.jdata)
+		if err != nil {
+			t.Errorf("%v: %v", tc.desc, err)
+			continue
+		}
+		warnings, err := check_rblr_dataset(ds, "2025-06-14")
+		if (err != nil) != tc.fails {
+			t.Errorf("%v: error %v", tc.desc, err)
+		}
+		if len(warnings) != len(tc.warnings) {
+			t.Errorf("%v: warnings %q, want %q", tc.desc, warnings, tc.warnings)
+			continue
+		}
+		for i, w := range tc.warnings {
+			if !strings.Contains(warnings[i], w) {
+				t.Errorf("%v: warning %q, want %q", tc.desc, warnings[i], w)
+			}
+		}
+	}
+
+	// A database read straight from Alys has no export to check
+	warnings, err := check_rblr_dataset(RBLR_Dataset{Database: true}, "2025-06-14")
+	if err != nil || len(warnings) > 0 {
+		t.Errorf("database: %q, %v", warnings, err)
+	}
+}
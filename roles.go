@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Each user has a single role. Rally masters may only load results for the rally
+// codes listed against them in rupert_user_rallies.
+const (
+	roleAdmin = "admin" // Everything, including other events, routes and undoing imports
+	roleRally = "rally" // /rally for their own rally codes
+	roleRBLR  = "rblr"  // /rblr and its reports
+)
+
+var validRoles = []string{roleAdmin, roleRally, roleRBLR}
+
+// rupert_User is the logged in user making a request
+type rupert_User struct {
+	Name    string
+	Role    string
+	Rallies []string // Rally codes a rally master may load
+}
+
+// load_user reads a user and their permissions
+func load_user(username string) (rupert_User, error) {
+
+	u := rupert_User{Name: username}
+	role, err := getStringFromDB(DBH, "SELECT Role FROM rupert_users WHERE Username=?", "", username)
+	if err != nil {
+		return u, err
+	}
+	u.Role = role
+	rows, err := DBH.Query("SELECT RallyID FROM rupert_user_rallies WHERE Username=? ORDER BY RallyID", username)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rally string
+		err = rows.Scan(&rally)
+		if err != nil {
+			return u, err
+		}
+		u.Rallies = append(u.Rallies, rally)
+	}
+	return u, rows.Err()
+}
+
+// set_user_role records a user's role and, for rally masters, their rally codes
+func set_user_role(db dbrunner, username string, role string, rallies []string) error {
+
+	if !slices.Contains(validRoles, role) {
+		return fmt.Errorf("role must be one of %v", strings.Join(validRoles, ", "))
+	}
+	_, err := db.Exec("UPDATE rupert_users SET Role=? WHERE Username=?", role, username)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM rupert_user_rallies WHERE Username=?", username)
+	if err != nil {
+		return err
+	}
+	for _, rally := range rallies {
+		if role != roleRally {
+			break
+		}
+		_, err = db.Exec("INSERT INTO rupert_user_rallies (Username,RallyID) VALUES(?,?)", username, rally)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parse_rally_codes splits a comma separated list of rally codes
+func parse_rally_codes(x string) []string {
+
+	res := make([]string, 0)
+	for _, c := range strings.Split(x, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// may_load_rally is true if u is allowed to load results for the rally
+func may_load_rally(u rupert_User, rallycode string) bool {
+
+	switch u.Role {
+	case roleAdmin:
+		return true
+	case roleRally:
+		return slices.Contains(u.Rallies, strings.ToUpper(rallycode))
+	}
+	return false
+}
+
+// require_role wraps handlers which only some users may use
+func require_role(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+
+	return require_login(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(roles, current_user(r).Role) {
+			show_forbidden(w, "You don't have permission to use this page.")
+			return
+		}
+		h(w, r)
+	})
+}
+
+func show_forbidden(w http.ResponseWriter, msg string) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	render(w, "forbidden", msg)
+}
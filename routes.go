@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The RBLR routes are held in the rblr_routes table so that they can be maintained
+// using /routes as the event changes. Codes must match those used by Alys.
+//
+// Routes and mileages vary from year to year so each route record may be limited to
+// a range of ride dates. Where more than one record for a code covers a date, the one
+// with the latest EffectiveFrom is used, so an open ended record can serve as the
+// default with older versions added alongside it. A route is retired by giving it an
+// EffectiveTo date, so results from before then can still be loaded.
+
+type RBLR_Route struct {
+	Routeid       int64
+	Code          string
+	Start         string
+	Via           string
+	Finish        string
+	RideName      string // For finishers within 24 hours
+	LateRideName  string // For late finishers
+	Miles         int
+	EffectiveFrom string // yyyy-mm-dd, blank if no limit
+	EffectiveTo   string
+}
+
+// The routes as they were before being moved into the database. As of 2024 the routes are
+// bidirectional to minimize certificate reprints so the 'via' contents need not be reorganized.
+var RBLR_Routes_2024 = []RBLR_Route{
+	{0, "A-NCW", "Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000-NC", "RBLR1000+NC", 1006, "", ""},
+	{0, "B-NAC", "Squires cafe", "Berwick-upon-Tweed, Wick and Fort William", "Squires cafe", "RBLR1000-NA", "RBLR1000+NA", 1006, "", ""},
+	{0, "C-SCW", "Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000-SC", "RBLR1000+SC", 1015, "", ""},
+	{0, "D-SAC", "Squires cafe", "Bangor, Barnstaple, Andover and Lowestoft", "Squires cafe", "RBLR1000-SA", "RBLR1000+SA", 1015, "", ""},
+	{0, "E-5CW", "Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000-5C", "RBLR1000+5C", 504, "", ""},
+	{0, "F-5AC", "Squires cafe", "Workington, Berwick-upon-Tweed and Beverley", "Squires cafe", "RBLR1000-5A", "RBLR1000+5A", 504, "", ""},
+}
+
+// seed_rblr_routes loads the original routes into an empty catalogue
+func seed_rblr_routes() {
+
+	n, err := getIntegerFromDB(DBH, "SELECT count(*) FROM rblr_routes", 0)
+	checkerr(err)
+	if n > 0 {
+		return
+	}
+	for _, rt := range RBLR_Routes_2024 {
+		checkerr(save_rblr_route(rt))
+	}
+}
+
+const rblrRouteCols = "routeid,RouteCode,Start,Via,Finish,RideName,LateRideName,Miles,EffectiveFrom,EffectiveTo"
+
+// load_rblr_routes returns every version of every route, in code order
+func load_rblr_routes(db dbrunner) ([]RBLR_Route, error) {
+
+	sqlx := "SELECT " + rblrRouteCols + " FROM rblr_routes ORDER BY RouteCode,EffectiveFrom,routeid"
+	rows, err := db.Query(sqlx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]RBLR_Route, 0)
+	for rows.Next() {
+		var rt RBLR_Route
+		err = rows.Scan(&rt.Routeid, &rt.Code, &rt.Start, &rt.Via, &rt.Finish, &rt.RideName, &rt.LateRideName, &rt.Miles, &rt.EffectiveFrom, &rt.EffectiveTo)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rt)
+	}
+	return res, rows.Err()
+}
+
+// rblr_routes_on returns the routes as they were on the date of a ride
+func rblr_routes_on(db dbrunner, ridedate string) ([]RBLR_Route, error) {
+
+	routes, err := load_rblr_routes(db)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RBLR_Route, 0, len(routes))
+	for _, rt := range routes {
+		if rt.EffectiveFrom > ridedate || (rt.EffectiveTo != "" && rt.EffectiveTo < ridedate) {
+			continue
+		}
+		// Routes are in EffectiveFrom order so a later version replaces an earlier one
+		if n := len(res); n > 0 && res[n-1].Code == rt.Code {
+			res[n-1] = rt
+			continue
+		}
+		res = append(res, rt)
+	}
+	return res, nil
+}
+
+// find_rblr_route looks up a route by its code
+func find_rblr_route(routes []RBLR_Route, code string) (RBLR_Route, bool) {
+
+	for _, rt := range routes {
+		if rt.Code == code {
+			return rt, true
+		}
+	}
+	return RBLR_Route{}, false
+}
+
+// save_rblr_route inserts a new route, if Routeid is zero, or updates an existing one
+func save_rblr_route(rt RBLR_Route) error {
+
+	if rt.Routeid == 0 {
+		sqlx := "INSERT INTO rblr_routes (RouteCode,Start,Via,Finish,RideName,LateRideName,Miles,EffectiveFrom,EffectiveTo) VALUES(?,?,?,?,?,?,?,?,?)"
+		_, err := DBH.Exec(sqlx, rt.Code, rt.Start, rt.Via, rt.Finish, rt.RideName, rt.LateRideName, rt.Miles, rt.EffectiveFrom, rt.EffectiveTo)
+		return err
+	}
+	sqlx := "UPDATE rblr_routes SET RouteCode=?,Start=?,Via=?,Finish=?,RideName=?,LateRideName=?,Miles=?,EffectiveFrom=?,EffectiveTo=? WHERE routeid=?"
+	_, err := DBH.Exec(sqlx, rt.Code, rt.Start, rt.Via, rt.Finish, rt.RideName, rt.LateRideName, rt.Miles, rt.EffectiveFrom, rt.EffectiveTo, rt.Routeid)
+	return err
+}
+
+// parse_rblr_route extracts a route from the edit form
+func parse_rblr_route(r *http.Request) (RBLR_Route, error) {
+
+	var rt RBLR_Route
+	rt.Routeid, _ = strconv.ParseInt(r.FormValue("routeid"), 10, 64)
+	rt.Code = strings.ToUpper(strings.TrimSpace(r.FormValue("RouteCode")))
+	rt.Start = strings.TrimSpace(r.FormValue("Start"))
+	rt.Via = strings.TrimSpace(r.FormValue("Via"))
+	rt.Finish = strings.TrimSpace(r.FormValue("Finish"))
+	rt.RideName = strings.TrimSpace(r.FormValue("RideName"))
+	rt.LateRideName = strings.TrimSpace(r.FormValue("LateRideName"))
+	rt.EffectiveFrom = strings.TrimSpace(r.FormValue("EffectiveFrom"))
+	rt.EffectiveTo = strings.TrimSpace(r.FormValue("EffectiveTo"))
+	for _, d := range []string{rt.EffectiveFrom, rt.EffectiveTo} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return rt, fmt.Errorf("'%v' is not a valid date", d)
+		}
+	}
+	if rt.EffectiveTo != "" && rt.EffectiveTo < rt.EffectiveFrom {
+		return rt, fmt.Errorf("a route can't end before it starts")
+	}
+	if rt.Code == "" || rt.RideName == "" {
+		return rt, fmt.Errorf("a route needs both a code and a ride name")
+	}
+	miles, err := strconv.Atoi(strings.TrimSpace(r.FormValue("Miles")))
+	if err != nil || miles < 1 {
+		return rt, fmt.Errorf("miles must be a whole number")
+	}
+	rt.Miles = miles
+	return rt, nil
+}
+
+// show_routes maintains the RBLR route catalogue
+func show_routes(w http.ResponseWriter, r *http.Request) {
+
+	if !allow_methods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	var data struct {
+		CSRF    string
+		Message string
+		Error   string
+		Routes  []RBLR_Route
+	}
+	data.CSRF = csrf_token(r)
+
+	if r.Method == http.MethodPost {
+		rt, err := parse_rblr_route(r)
+		if err == nil {
+			err = save_rblr_route(rt)
+		}
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Message = fmt.Sprintf("Route %v has been saved", rt.Code)
+		}
+	}
+
+	routes, err := load_rblr_routes(DBH)
+	if err != nil {
+		data.Error = err.Error()
+	}
+	// The last line is for adding a new route
+	data.Routes = append(routes, RBLR_Route{})
+	render(w, "routes", data)
+
+}
@@ -20,22 +20,16 @@ function enableImportLoad(obj) {
 
   let csv = document.getElementById("thefile");
   if (!csv) return;
-  let data = document.getElementById("thedata");
-  if (!data) return;
+  // The file itself is uploaded with the form
   const file = csv.files[0];
   console.log("File is " + file);
   if (file) {
-    const reader = new FileReader();
-    reader.onload = function (e) {
-      const content = e.target.result;
-      data.value = content;
-
-      if (ldr) {
-        ldr.disabled = false;
-        ldr.classList.add("btn")
-        ldr.classList.remove("hide");
+    for (let btn of [ldr, document.getElementById("previewbutton")]) {
+      if (btn) {
+        btn.disabled = false;
+        btn.classList.add("btn");
+        btn.classList.remove("hide");
       }
-    };
-    reader.readAsText(file);
+    }
   }
 }
@@ -0,0 +1,121 @@
+package main
+
+// Tables owned by Rupert itself rather than by the Rides database front end.
+// They are created on startup if they don't already exist.
+var rupertschema = []string{
+	`CREATE TABLE IF NOT EXISTS rupert_batches (
+		batchid INTEGER PRIMARY KEY,
+		BatchType TEXT,
+		Source TEXT,
+		FileHash TEXT,
+		LoadedBy TEXT,
+		LoadedAt TEXT,
+		UndoneAt TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_journal (
+		recid INTEGER PRIMARY KEY,
+		batchid INTEGER,
+		TableName TEXT,
+		KeyName TEXT,
+		KeyValue,
+		Action TEXT,
+		PriorValues TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS rupert_journal_batch ON rupert_journal (batchid)`,
+	`CREATE TABLE IF NOT EXISTS rupert_sequences (
+		TableName TEXT PRIMARY KEY,
+		NextID INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS rblr_routes (
+		routeid INTEGER PRIMARY KEY,
+		RouteCode TEXT,
+		Start TEXT,
+		Via TEXT,
+		Finish TEXT,
+		RideName TEXT,
+		LateRideName TEXT,
+		Miles INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_users (
+		userid INTEGER PRIMARY KEY,
+		Username TEXT NOT NULL UNIQUE,
+		PasswordHash TEXT NOT NULL,
+		CreatedAt TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_logins (
+		TokenHash TEXT PRIMARY KEY,
+		Username TEXT NOT NULL,
+		Expires INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_user_rallies (
+		Username TEXT NOT NULL,
+		RallyID TEXT NOT NULL,
+		PRIMARY KEY (Username,RallyID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS rblr_participation (
+		recid INTEGER PRIMARY KEY,
+		Ridedate TEXT,
+		EntrantID INTEGER,
+		RiderName TEXT,
+		PillionName TEXT,
+		RouteCode TEXT,
+		EntrantStatus INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_uploads (
+		FileHash TEXT PRIMARY KEY,
+		UploadedBy TEXT,
+		UploadedAt INTEGER,
+		Data BLOB
+	)`,
+	`CREATE TABLE IF NOT EXISTS rally_dates (
+		RallyID TEXT PRIMARY KEY,
+		StartDate TEXT,
+		FinishDate TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS rallyresult_classes (
+		recid INTEGER PRIMARY KEY, -- rallyresults.recid
+		ClassName TEXT NOT NULL DEFAULT '',
+		Team TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS rupert_event_templates (
+		TemplateName TEXT PRIMARY KEY,
+		Mapping TEXT,
+		SavedBy TEXT,
+		SavedAt TEXT
+	)`,
+}
+
+func ensure_rupert_tables() {
+
+	for _, sqlx := range rupertschema {
+		_, err := DBH.Exec(sqlx)
+		checkerr(err)
+	}
+	for _, c := range rupertcolumns {
+		checkerr(ensure_column(c.Table, c.Column, c.Decl))
+	}
+	seed_rblr_routes()
+}
+
+// Columns added to Rupert's tables after they were first released. Tables belonging to
+// the Rides database front end are left alone.
+var rupertcolumns = []struct {
+	Table  string
+	Column string
+	Decl   string
+}{
+	{"rblr_routes", "EffectiveFrom", "TEXT NOT NULL DEFAULT ''"},
+	{"rblr_routes", "EffectiveTo", "TEXT NOT NULL DEFAULT ''"},
+	{"rupert_users", "Role", "TEXT NOT NULL DEFAULT ''"}, // No access until a role is given
+}
+
+// ensure_column adds a column to an existing table unless it's already there
+func ensure_column(table string, column string, decl string) error {
+
+	n, err := getIntegerFromDB(DBH, "SELECT count(*) FROM pragma_table_info(?) WHERE name=?", 0, table, column)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = DBH.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Rally results can be loaded straight from the ScoreMaster database rather than from
+// a CSV export, which doesn't include the odometer units, class names, teams or the
+// dates of the rally. Columns are looked up by name as they vary between versions.
+
+// ScoreMaster EntrantStatus of a finisher
+const smFinisher = 8
+
+// scoremaster_Rally holds the rally parameters from a ScoreMaster database
+type scoremaster_Rally struct {
+	Title      string
+	StartDate  string // yyyy-mm-dd
+	FinishDate string
+}
+
+// parse_scoremaster reads an uploaded ScoreMaster database
+func parse_scoremaster(data []byte) (sr scoremaster_Rally, res []rally_Entrant, problems []string) {
+
+	err := with_temp_db(data, func(path string) {
+		sr, res, problems = read_scoremaster_file(path)
+	})
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	return
+}
+
+// read_scoremaster_file reads the rally parameters and finishers from a ScoreMaster database
+func read_scoremaster_file(path string) (scoremaster_Rally, []rally_Entrant, []string) {
+
+	var sr scoremaster_Rally
+	res := make([]rally_Entrant, 0)
+
+	db, err := open_source_db(path)
+	if err != nil {
+		return sr, res, []string{err.Error()}
+	}
+	defer db.Close()
+
+	for _, t := range []string{"rallyparams", "entrants"} {
+		ok, err := sqlite_has_table(db, t)
+		if err != nil {
+			return sr, res, []string{err.Error()}
+		}
+		if !ok {
+			return sr, res, []string{fmt.Sprintf("This isn't a ScoreMaster database, it has no %v table", t)}
+		}
+	}
+
+	params, err := sqlite_rows(db, "SELECT * FROM rallyparams")
+	if err != nil {
+		return sr, res, []string{err.Error()}
+	}
+	if len(params) > 0 {
+		sr.Title = params[0]["rallytitle"]
+		sr.StartDate = scoremaster_date(params[0]["starttime"])
+		sr.FinishDate = scoremaster_date(params[0]["finishtime"])
+	}
+	classes, err := scoremaster_names(db, "classes", "class")
+	if err != nil {
+		return sr, res, []string{err.Error()}
+	}
+	teams, err := scoremaster_names(db, "teams", "teamid")
+	if err != nil {
+		return sr, res, []string{err.Error()}
+	}
+
+	entrants, err := sqlite_rows(db, "SELECT * FROM entrants WHERE EntrantStatus=? ORDER BY FinishPosition,EntrantID", smFinisher)
+	if err != nil {
+		return sr, res, []string{err.Error()}
+	}
+	problems := make([]string, 0)
+	for _, e := range entrants {
+		var re rally_Entrant
+		re.RiderName = e["ridername"]
+		re.PillionName = e["pillionname"]
+		re.Bike = e["bike"]
+		re.BikeReg = e["bikereg"]
+		re.Placing = sqlite_int(e["finishposition"])
+		re.Miles = sqlite_int(e["correctedmiles"])
+		re.Points = sqlite_int(e["totalpoints"])
+		re.RiderIBA = sqlite_int(e["rideriba"])
+		re.PillionIBA = sqlite_int(e["pillioniba"])
+		re.Class = sqlite_int(e["class"])
+		re.ClassName = classes[e["class"]]
+		re.Team = teams[e["teamid"]]
+		re.Phone = e["phone"]
+		re.Email = e["email"]
+		re.Postcode = e["postcode"]
+		re.Country = e["country"]
+		re.RiderRBL = e["riderrbl"]
+		re.NoviceRider = e["novicerider"]
+		re.PillionRBL = e["pillionrbl"]
+		re.NovicePillion = e["novicepillion"]
+		if sqlite_int(e["odokms"]) != 0 {
+			re.KmsOdo = "Y"
+		}
+		addr := make([]string, 0, 4)
+		for _, k := range []string{"address1", "address2", "town", "county"} {
+			if e[k] != "" {
+				addr = append(addr, e[k])
+			}
+		}
+		re.Postal_Address = strings.Join(addr, " | ")
+		if re.RiderName == "" {
+			problems = append(problems, fmt.Sprintf("Entrant %v: no rider name", e["entrantid"]))
+			continue
+		}
+		res = append(res, re)
+	}
+	if len(res) < 1 && len(problems) < 1 {
+		problems = append(problems, "There are no finishers in the ScoreMaster database")
+	}
+	return sr, res, problems
+}
+
+// scoremaster_names maps the keys of a lookup table such as classes to their BriefDesc
+func scoremaster_names(db *sql.DB, table string, key string) (map[string]string, error) {
+
+	res := make(map[string]string)
+	ok, err := sqlite_has_table(db, table)
+	if err != nil || !ok {
+		return res, err
+	}
+	rows, err := sqlite_rows(db, "SELECT * FROM "+table)
+	if err != nil {
+		return res, err
+	}
+	for _, r := range rows {
+		if r["briefdesc"] != "" {
+			res[r[key]] = r["briefdesc"]
+		}
+	}
+	return res, nil
+}
+
+// scoremaster_date extracts the date from a ScoreMaster timestamp
+func scoremaster_date(x string) string {
+
+	if len(x) < 10 {
+		return ""
+	}
+	return x[:10]
+}
+
+// use_scoremaster_rally fills in anything the operator left blank from the ScoreMaster
+// rally parameters. It returns a warning if the year being loaded doesn't match.
+func use_scoremaster_rally(rp *rally_Params, sr scoremaster_Rally) string {
+
+	if rp.Desc == "" {
+		rp.Desc = sr.Title
+	}
+	rp.StartDate = sr.StartDate
+	rp.FinishDate = sr.FinishDate
+	if len(sr.StartDate) < 4 {
+		return ""
+	}
+	if rp.Year == "" {
+		rp.Year = sr.StartDate[2:4]
+	} else if rp.Year != sr.StartDate[2:4] {
+		return fmt.Sprintf("ScoreMaster says the rally started on %v but the results are for 20%v", sr.StartDate, rp.Year)
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Keys in the Rides database are not autogenerated. The PHP front end allocates
+// its own using max()+1 so we must take account of that as well as our own record
+// of keys issued, which stops keys from undone imports being reused.
+
+var sequenceKeys = map[string]string{
+	"riders":       "riderid",
+	"bikes":        "bikeid",
+	"rides":        "URI",
+	"rallyresults": "recid",
+}
+
+// allocate_id reserves the next unique key for table. It must be called within a
+// transaction holding the database write lock, which is what DBH.Begin provides.
+func allocate_id(tx *sql.Tx, table string) (int64, error) {
+
+	keycol, ok := sequenceKeys[table]
+	if !ok {
+		return 0, fmt.Errorf("no key sequence for table %v", table)
+	}
+	maxid, err := getIntegerFromDB(tx, "SELECT max("+keycol+") FROM "+table, 0)
+	if err != nil {
+		return 0, err
+	}
+	next, err := getIntegerFromDB(tx, "SELECT NextID FROM rupert_sequences WHERE TableName=?", 0, table)
+	if err != nil {
+		return 0, err
+	}
+	id := max(maxid+1, next)
+	_, err = tx.Exec("INSERT OR REPLACE INTO rupert_sequences (TableName,NextID) VALUES(?,?)", table, id+1)
+	return id, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import "database/sql"
+
+// import_Session carries everything belonging to one run of an importer so that
+// concurrent requests don't trample on each other.
+type import_Session struct {
+	tx          *sql.Tx
+	Batch       int64 // rupert_batches key, zero if not journalling
+	Preview     bool
+	Stats       Stats
+	NewIBAs     []string
+	Warnings    []string
+	Actions     []import_Action
+	Resolutions map[string]int64 // Operator's choices, see parse_resolutions
+	Riders      []indexed_Rider  // Riders on file, and any added by this run
+	Routes      []RBLR_Route     // Active RBLR routes
+}
+
+// new_import_session prepares to import a file, with any choices made by the operator.
+// The riders loaded here are only used to reconcile the file, run_import loads them
+// again once it has the database to itself.
+func new_import_session(preview bool, resolutions map[string]int64) (*import_Session, error) {
+
+	sess := &import_Session{}
+	sess.Preview = preview
+	sess.Resolutions = resolutions
+	riders, err := load_rider_index(DBH)
+	if err != nil {
+		return nil, err
+	}
+	sess.Riders = riders
+	sess.Stats.Routes = make(map[string]int)
+	return sess, nil
+}
+
+// run_import calls post within a single transaction. The transaction is committed
+// unless post fails or this is only a preview.
+func run_import(sess *import_Session, post func(*import_Session) error) error {
+
+	tx, err := DBH.Begin()
+	if err != nil {
+		return err
+	}
+	sess.tx = tx
+	defer func() { sess.tx = nil }()
+
+	// Another import may have added riders since the session started
+	sess.Riders, err = load_rider_index(tx)
+	if err == nil {
+		err = post(sess)
+	}
+	if err != nil || sess.Preview {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RBLR_Status is the EntrantStatus recorded by Alys. Only the finisher codes, which
+// Rupert has always relied on, are known for certain. Other statuses are reported by
+// number rather than guessed at.
+//
+// Alys also has codes for entrants who didn't start, didn't finish or withdrew. They
+// belong here, with their descriptions, once taken from the Alys source; until then
+// the enum is incomplete and the breakdown on the results page shows them by number.
+type RBLR_Status int
+
+const (
+	Finisher     RBLR_Status = 8
+	LateFinisher RBLR_Status = 10
+)
+
+var rblrStatusDescs = map[RBLR_Status]string{
+	Finisher:     "Finisher",
+	LateFinisher: "Late finisher",
+}
+
+func (s RBLR_Status) String() string {
+
+	if d, ok := rblrStatusDescs[s]; ok {
+		return d
+	}
+	return fmt.Sprintf("Status %d", int(s))
+}
+
+// rblr_has_started is true if the entrant actually set off, judged by the finisher codes
+// or a start time rather than by any other status.
+func rblr_has_started(e RBLR_Entrant) bool {
+
+	return e.EntrantStatus == Finisher || e.EntrantStatus == LateFinisher || strings.TrimSpace(e.StartTime) != ""
+}
+
+// status_Count is the number of entrants in a file with each status
+type status_Count struct {
+	Status RBLR_Status
+	Count  int
+}
+
+// rblr_status_counts summarises the entrants in the file by status
+func rblr_status_counts(entrants []RBLR_Entrant) []status_Count {
+
+	counts := make(map[RBLR_Status]int)
+	for _, e := range entrants {
+		counts[e.EntrantStatus]++
+	}
+	res := make([]status_Count, 0, len(counts))
+	for s, n := range counts {
+		res = append(res, status_Count{s, n})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Status < res[j].Status })
+	return res
+}
+
+// post_rblr_participation records everyone who started, whether or not they
+// finished, so that starters and finishers can be reported by route and year.
+func post_rblr_participation(sess *import_Session, entrants []RBLR_Entrant, rp RBLR_Params) error {
+
+	for _, e := range entrants {
+		if !rblr_has_started(e) {
+			continue
+		}
+		n, err := getIntegerFromDB(sess.tx, "SELECT count(*) FROM rblr_participation WHERE Ridedate=? AND EntrantID=?", 0, rp.Ridedate, e.EntrantID)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		sqlx := "INSERT INTO rblr_participation (Ridedate,EntrantID,RiderName,PillionName,RouteCode,EntrantStatus) VALUES(?,?,?,?,?,?)"
+		res, err := sess.tx.Exec(sqlx, rp.Ridedate, e.EntrantID, strings.TrimSpace(e.Rider.First+" "+e.Rider.Last), strings.TrimSpace(e.Pillion.First+" "+e.Pillion.Last), e.Route, e.EntrantStatus)
+		if err != nil {
+			return err
+		}
+		recid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		err = journal_insert(sess, "rblr_participation", recid)
+		if err != nil {
+			return err
+		}
+		sess.Stats.Participants++
+	}
+	return nil
+}
+
+// show_participation reports starters and finishers by year and route
+func show_participation(w http.ResponseWriter, r *http.Request) {
+
+	if !allow_methods(w, r, http.MethodGet) {
+		return
+	}
+
+	type participation_Row struct {
+		Year      string
+		Route     string
+		Starters  int
+		Finishers int
+		Late      int
+		DNF       int
+	}
+	var data struct {
+		Error string
+		Rows  []participation_Row
+	}
+
+	// Everyone recorded started so those who didn't finish are the rest
+	sqlx := `SELECT substr(Ridedate,1,4),RouteCode,count(*),
+		sum(EntrantStatus=?),sum(EntrantStatus=?),sum(EntrantStatus NOT IN (?,?))
+		FROM rblr_participation GROUP BY substr(Ridedate,1,4),RouteCode ORDER BY 1 DESC,2`
+	rows, err := DBH.Query(sqlx, Finisher, LateFinisher, Finisher, LateFinisher)
+	if err != nil {
+		data.Error = err.Error()
+		render(w, "participation", data)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p participation_Row
+		err = rows.Scan(&p.Year, &p.Route, &p.Starters, &p.Finishers, &p.Late, &p.DNF)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		data.Rows = append(data.Rows, p)
+	}
+	render(w, "participation", data)
+
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Results files are uploaded as the thefile part of a multipart form. Rather than
+// sending the file back and forth through the preview and reconciliation pages it's
+// kept in rupert_uploads, for a day at most, and they pass on its hash. The thedata field is still accepted
+// for scripts which post the text of the file.
+
+// MaxUpload limits the size of a results file
+var MaxUpload *int64 = flag.Int64("maxupload", 32<<20, "largest results file accepted, in bytes")
+
+const (
+	uploadField    = "upload"
+	uploadLifetime = 24 * time.Hour
+	uploadMemory   = 8 << 20 // Parts above this are spooled to disk while parsing
+)
+
+// limit_upload wraps import handlers to cap the size of what may be posted. Nothing is
+// read until parse_post, once the user has logged in.
+func limit_upload(h http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			r.Body = http.MaxBytesReader(w, r.Body, *MaxUpload+uploadMemory)
+		}
+		h(w, r)
+	}
+}
+
+// parse_post parses a posted form, spooling large files to disk, before anything else
+// reads it. A post over the limit set by limit_upload is refused, returning false.
+func parse_post(w http.ResponseWriter, r *http.Request) bool {
+
+	err := r.ParseMultipartForm(uploadMemory)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		render(w, "import", import_Page{Title: "Results file too big", Problems: []string{upload_limit_message()}})
+		return false
+	}
+	return true
+}
+
+func upload_limit_message() string {
+
+	if *MaxUpload < 1<<20 {
+		return fmt.Sprintf("Results files may be no bigger than %v KB", *MaxUpload>>10)
+	}
+	return fmt.Sprintf("Results files may be no bigger than %v MB", *MaxUpload>>20)
+}
+
+// read_upload returns the results file posted to an import page and its hash, or nil
+// if there isn't one.
+func read_upload(r *http.Request) ([]byte, string, error) {
+
+	user := current_user(r).Name
+	if hash := r.FormValue(uploadField); hash != "" {
+		var data []byte
+		err := DBH.QueryRow("SELECT Data FROM rupert_uploads WHERE FileHash=? AND UploadedBy=?", hash, user).Scan(&data)
+		if err != nil {
+			return nil, "", errors.New("The uploaded file has expired, please upload it again")
+		}
+		return data, hash, nil
+	}
+
+	var data []byte
+	f, _, err := r.FormFile("thefile")
+	if err == nil {
+		defer f.Close()
+		data, err = io.ReadAll(io.LimitReader(f, *MaxUpload+1))
+		if err != nil {
+			return nil, "", err
+		}
+		if int64(len(data)) > *MaxUpload {
+			return nil, "", errors.New(upload_limit_message())
+		}
+	}
+	if len(data) == 0 {
+		data = []byte(r.PostFormValue("thedata"))
+	}
+	if len(data) == 0 {
+		return nil, "", nil
+	}
+
+	h := sha256.Sum256(data)
+	hash := hex.EncodeToString(h[:])
+	_, err = DBH.Exec("INSERT OR REPLACE INTO rupert_uploads (FileHash,UploadedBy,UploadedAt,Data) VALUES(?,?,?,?)", hash, user, time.Now().Unix(), data)
+	return data, hash, err
+}
+
+// purge_uploads deletes uploads older than uploadLifetime. They hold everything in the
+// results file, including next of kin, so aren't kept for a moment longer than needed.
+func purge_uploads() error {
+
+	_, err := DBH.Exec("DELETE FROM rupert_uploads WHERE UploadedAt<?", time.Now().Add(-uploadLifetime).Unix())
+	return err
+}
+
+// purge_uploads_hourly keeps purging uploads for as long as Rupert is serving
+func purge_uploads_hourly() {
+
+	for range time.Tick(time.Hour) {
+		if err := purge_uploads(); err != nil {
+			fmt.Printf("Purging uploads: %v\n", err)
+		}
+	}
+}
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// Windows-1252 differs from Latin-1 only in 0x80-0x9F. Unused codes map to themselves.
+var cp1252 = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// decode_text returns the text of an uploaded CSV or JSON file as UTF-8. Files saved by
+// Excel may start with a byte order mark or, if not Unicode, use Windows-1252.
+func decode_text(data []byte) string {
+
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return string(data[len(utf8BOM):])
+	case bytes.HasPrefix(data, utf16LEBOM):
+		return decode_utf16(data[2:], false)
+	case bytes.HasPrefix(data, utf16BEBOM):
+		return decode_utf16(data[2:], true)
+	case utf8.Valid(data):
+		return string(data)
+	}
+	res := make([]rune, 0, len(data))
+	for _, b := range data {
+		if b >= 0x80 && b < 0xA0 {
+			res = append(res, cp1252[b-0x80])
+		} else {
+			res = append(res, rune(b))
+		}
+	}
+	return string(res)
+}
+
+func decode_utf16(data []byte, bigendian bool) string {
+
+	u := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigendian {
+			u = append(u, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			u = append(u, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Both ScoreMaster and Alys keep their data in SQLite so the database itself may be
+// uploaded instead of an export.
+
+const sqliteMagic = "SQLite format 3\x00"
+
+// is_sqlite is true if data looks like an SQLite database
+func is_sqlite(data []byte) bool {
+
+	return bytes.HasPrefix(data, []byte(sqliteMagic))
+}
+
+// with_temp_db calls read with the path of a copy of data, which the SQLite driver
+// can only open as a file.
+func with_temp_db(data []byte, read func(path string)) error {
+
+	f, err := os.CreateTemp("", "rupert-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	read(f.Name())
+	return nil
+}
+
+// open_source_db opens another application's database without changing it
+func open_source_db(path string) (*sql.DB, error) {
+
+	return sql.Open("sqlite3", "file:"+path+"?mode=ro")
+}
+
+// sqlite_has_table is true if the database has the named table
+func sqlite_has_table(db *sql.DB, table string) (bool, error) {
+
+	n, err := getIntegerFromDB(db, "SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?", 0, table)
+	return n > 0, err
+}
+
+// sqlite_rows returns the rows selected as maps keyed by lower case column name,
+// so that columns which vary between versions can be picked out by name.
+func sqlite_rows(db *sql.DB, sqlx string, args ...any) ([]map[string]string, error) {
+
+	rows, err := db.Query(sqlx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]map[string]string, 0)
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			row[strings.ToLower(c)] = strings.TrimSpace(vals[i].String)
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// sqlite_int reads a number which may have been stored as text or a real
+func sqlite_int(x string) int {
+
+	f, err := strconv.ParseFloat(x, 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Round(f))
+}
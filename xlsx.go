@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Rally masters often tidy the finishers list in Excel so .xlsx workbooks are accepted
+// as well as CSV. A workbook is a zip of XML parts: workbook.xml lists the sheets, its
+// relationships say which part holds each one, and most text is kept once in
+// sharedStrings.xml and referred to by index from the cells.
+
+const zipMagic = "PK\x03\x04"
+
+// xlsxMaxPart limits the unzipped size of any one part, so that a small upload can't
+// unpack into gigabytes
+const xlsxMaxPart = 64 << 20
+
+// Cells are placed by reference, so a tiny sheet could still refer to the far corner
+// of the grid. No results sheet comes near these.
+const (
+	xlsxMaxRows = 100000
+	xlsxMaxCols = 200
+)
+
+var errNoPart = errors.New("the workbook is incomplete")
+
+type xlsx_Workbook struct {
+	zr     *zip.Reader
+	Sheets []string          // Names, in workbook order
+	parts  map[string]string // Sheet name to zip entry
+	shared []string
+}
+
+type xlsx_Text struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (x xlsx_Text) text() string {
+
+	if len(x.Runs) == 0 {
+		return x.T
+	}
+	var sb strings.Builder
+	for _, r := range x.Runs {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+// is_xlsx is true if data looks like an Excel workbook
+func is_xlsx(data []byte) bool {
+
+	if !bytes.HasPrefix(data, []byte(zipMagic)) {
+		return false
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// open_xlsx reads the list of sheets and the shared strings of a workbook
+func open_xlsx(data []byte) (*xlsx_Workbook, error) {
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	wb := &xlsx_Workbook{zr: zr, parts: make(map[string]string)}
+
+	var rels struct {
+		Rels []struct {
+			Id     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	err = wb.decode("xl/_rels/workbook.xml.rels", &rels)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string)
+	for _, r := range rels.Rels {
+		t := r.Target
+		if strings.HasPrefix(t, "/") {
+			t = strings.TrimPrefix(t, "/")
+		} else {
+			t = path.Join("xl", t)
+		}
+		targets[r.Id] = t
+	}
+
+	var book struct {
+		Sheets []struct {
+			Name  string     `xml:"name,attr"`
+			Attrs []xml.Attr `xml:",any,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	err = wb.decode("xl/workbook.xml", &book)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range book.Sheets {
+		for _, a := range s.Attrs {
+			// The relationship id is r:id, whichever namespace r happens to be
+			if a.Name.Local == "id" && targets[a.Value] != "" {
+				wb.Sheets = append(wb.Sheets, s.Name)
+				wb.parts[s.Name] = targets[a.Value]
+			}
+		}
+	}
+	if len(wb.Sheets) < 1 {
+		return nil, errors.New("The workbook has no sheets")
+	}
+
+	var sst struct {
+		SI []xlsx_Text `xml:"si"`
+	}
+	err = wb.decode("xl/sharedStrings.xml", &sst)
+	if err != nil && !errors.Is(err, errNoPart) {
+		return nil, err
+	}
+	for _, si := range sst.SI {
+		wb.shared = append(wb.shared, si.text())
+	}
+	return wb, nil
+}
+
+// decode unmarshals one XML part of the workbook
+func (wb *xlsx_Workbook) decode(name string, v any) error {
+
+	for _, f := range wb.zr.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > xlsxMaxPart {
+			return fmt.Errorf("The workbook is too big to load, %v unzips to more than %v MB", name, xlsxMaxPart>>20)
+		}
+		rdr, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rdr.Close()
+		// The size in the zip directory can't be trusted, so the limit is enforced here too
+		b, err := io.ReadAll(io.LimitReader(rdr, xlsxMaxPart+1))
+		if err != nil {
+			return err
+		}
+		if len(b) > xlsxMaxPart {
+			return fmt.Errorf("The workbook is too big to load, %v unzips to more than %v MB", name, xlsxMaxPart>>20)
+		}
+		return xml.Unmarshal(b, v)
+	}
+	return fmt.Errorf("%w: %v", errNoPart, name)
+}
+
+// rows returns the cell text of a sheet, the first sheet if none is named. Rows and
+// columns are placed as in Excel, so row numbers in any problems reported match.
+func (wb *xlsx_Workbook) rows(sheet string) ([][]string, error) {
+
+	if sheet == "" {
+		sheet = wb.Sheets[0]
+	}
+	part, ok := wb.parts[sheet]
+	if !ok {
+		return nil, fmt.Errorf("The workbook has no sheet called '%v'", sheet)
+	}
+	var ws struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R  string    `xml:"r,attr"`
+				T  string    `xml:"t,attr"`
+				V  string    `xml:"v"`
+				IS xlsx_Text `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	err := wb.decode(part, &ws)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([][]string, 0, len(ws.Rows))
+	for _, row := range ws.Rows {
+		if row.R > xlsxMaxRows || len(res) >= xlsxMaxRows {
+			return nil, fmt.Errorf("The sheet '%v' has more than %v rows", sheet, xlsxMaxRows)
+		}
+		for row.R > len(res)+1 {
+			res = append(res, []string{})
+		}
+		ln := make([]string, 0, min(len(row.Cells), xlsxMaxCols))
+		for _, c := range row.Cells {
+			col := xlsx_column(c.R)
+			if col >= xlsxMaxCols || len(ln) >= xlsxMaxCols {
+				return nil, fmt.Errorf("The sheet '%v' has more than %v columns, at row %v", sheet, xlsxMaxCols, len(res)+1)
+			}
+			if col > len(ln) {
+				ln = append(ln, make([]string, col-len(ln))...)
+			}
+			ln = append(ln, wb.cell_text(c.T, c.V, c.IS))
+		}
+		res = append(res, ln)
+	}
+	return res, nil
+}
+
+// cell_text interprets a cell according to its type
+func (wb *xlsx_Workbook) cell_text(t string, v string, is xlsx_Text) string {
+
+	switch t {
+	case "s":
+		ix, err := strconv.Atoi(v)
+		if err != nil || ix < 0 || ix >= len(wb.shared) {
+			return ""
+		}
+		return wb.shared[ix]
+	case "inlineStr":
+		return is.text()
+	case "b":
+		if v == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "str", "e":
+		return v
+	}
+	// Numbers are stored in full, 1500 may well be 1500.0000000001
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return v
+	}
+	return strconv.FormatFloat(math.Round(f*1e9)/1e9, 'f', -1, 64)
+}
+
+// xlsx_column returns the zero based column of a cell reference such as "C5", or -1
+func xlsx_column(ref string) int {
+
+	col := 0
+	n := 0
+	for _, c := range strings.ToUpper(ref) {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+		n++
+	}
+	if n == 0 {
+		return -1
+	}
+	return col - 1
+}
+
+// parse_rally_xlsx reads a finishers sheet through the same column mapping as CSV
+func parse_rally_xlsx(wb *xlsx_Workbook, sheet string) ([]rally_Entrant, []string) {
+
+	recs, err := wb.rows(sheet)
+	if err != nil {
+		return []rally_Entrant{}, []string{err.Error()}
+	}
+	return parse_rally_records(recs)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// test_workbook zips up a workbook of one sheet holding sheetData
+func test_workbook(t *testing.T, sheetData string) *xlsx_Workbook {
+
+	parts := map[string]string{
+		"xl/workbook.xml":            `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Finishers" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships><Relationship Id="rId1" Type="x" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml":   `<worksheet><sheetData>` + sheetData + `</sheetData></worksheet>`,
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, x := range parts {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(x))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wb, err := open_xlsx(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wb
+}
+
+func TestXLSXRows(t *testing.T) {
+
+	tests := []struct {
+		desc      string
+		sheetData string
+		rows      int
+		problem   string
+	}{
+		{"placed by reference", `<row r="1"><c r="A1" t="inlineStr"><is><t>Name</t></is></c><c r="C1" t="inlineStr"><is><t>Miles</t></is></c></row><row r="3"><c r="A3"><v>1</v></c></row>`, 3, ""},
+		{"far column", `<row r="1"><c r="XFD1"><v>1</v></c></row>`, 0, "columns"},
+		{"too many cells", `<row r="1">` + strings.Repeat(`<c><v>1</v></c>`, xlsxMaxCols+1) + `</row>`, 0, "columns"},
+		{"far row", `<row r="1048576"><c r="A1048576"><v>1</v></c></row>`, 0, "rows"},
+	}
+	for _, tc := range tests {
+		recs, err := test_workbook(t, tc.sheetData).rows("")
+		if tc.problem == "" {
+			if err != nil || len(recs) != tc.rows {
+				t.Errorf("%v: %v rows, %v", tc.desc, len(recs), err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%v: error %v, want one about %v", tc.desc, err, tc.problem)
+		}
+	}
+}